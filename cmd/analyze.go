@@ -0,0 +1,164 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bbeesley/fn-push/pkg/archive"
+	"github.com/spf13/cobra"
+)
+
+//go:embed analyze.html
+var analyzeTemplate string
+
+// Analysis describes what a bundle is made of
+type Analysis struct {
+	Zipped   int64             `json:"zipped"`
+	Unzipped int64             `json:"unzipped"`
+	Tree     *archive.Node     `json:"tree"`
+	Packages []archive.Package `json:"packages"`
+}
+
+var analyzeDepth int
+var htmlOutput string
+
+// Builds the analysis of a function zip, if there is one, and its layer zips. Each layer's files are listed under
+// a directory named after the layer's zip, so they can't be mistaken for files in the function zip.
+func analyze(functionData *bytes.Buffer, layers []layerZip) Analysis {
+	var summary archive.Summary
+	if functionData != nil {
+		var err error
+		summary, err = archive.Read(functionData.Bytes())
+		if err != nil {
+			log.Fatalf("Failed to read zip: %v", err)
+		}
+	}
+	for _, layer := range layers {
+		layerSummary, err := archive.Read(layer.data.Bytes())
+		if err != nil {
+			log.Fatalf("Failed to read layer zip %s: %v", layer.key, err)
+		}
+		for ix := range layerSummary.Files {
+			layerSummary.Files[ix].Name = path.Join(keyName(layer.key, ""), layerSummary.Files[ix].Name)
+		}
+		summary = archive.Merge(summary, layerSummary)
+	}
+	return Analysis{
+		Zipped:   summary.Zipped,
+		Unzipped: summary.Unzipped,
+		Tree:     summary.Tree(),
+		Packages: summary.Packages(),
+	}
+}
+
+// Prints the directory tree down to the given depth, with unzipped and zipped sizes
+func printTree(node *archive.Node, depth int, maxDepth int) {
+	fmt.Printf("%10s %10s  %s%s\n", formatBytes(node.Size), formatBytes(node.CompressedSize), strings.Repeat("  ", depth), node.Name)
+	if depth >= maxDepth {
+		return
+	}
+	for _, child := range node.Children {
+		printTree(child, depth+1, maxDepth)
+	}
+}
+
+// Writes the analysis as a self-contained HTML treemap
+func writeTreemap(path string, analysis Analysis) {
+	tmpl, err := template.New("analyze").Parse(analyzeTemplate)
+	if err != nil {
+		log.Fatalf("Failed to parse treemap template: %v", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Failed to create '%s': %v", path, err)
+	}
+	defer f.Close()
+	err = tmpl.Execute(f, analysis)
+	if err != nil {
+		log.Fatalf("Failed to write treemap: %v", err)
+	}
+}
+
+// analyzeCmd represents the analyze command
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze",
+	Short: "Show what takes up the space in a bundle",
+	Long: `Bundles the function and layer zips from the inputPath the
+	same way the aws command does (or reads an --artifact), and prints
+	the unzipped and zipped size of each directory and npm package, so
+	you can see what's bloating the bundle. Files split into a layer
+	with --layerKey or --layer are listed under the layer's zip name. Use --json to track sizes over time, or --html to write an
+	interactive treemap.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		applyPreset(cmd.Flags(), &lambdaRuntime)
+		var analysis Analysis
+		if artifact != "" {
+			analysis = analyze(loadArtifact(artifact), nil)
+		} else {
+			analysis = analyze(lambdaBundles(cmd.Flags(), progressWriter()))
+		}
+
+		if htmlOutput != "" {
+			writeTreemap(htmlOutput, analysis)
+		}
+		if jsonOutput {
+			output, err := json.MarshalIndent(analysis, "", "  ")
+			if err != nil {
+				log.Fatalf("Failed to encode analysis: %v", err)
+			}
+			fmt.Println(string(output))
+			return
+		}
+		fmt.Printf("%10s %10s  %s\n", "UNZIPPED", "ZIPPED", "PATH")
+		printTree(analysis.Tree, 0, analyzeDepth)
+		if len(analysis.Packages) > 0 {
+			fmt.Printf("\n%10s %10s  %s\n", "UNZIPPED", "ZIPPED", "PACKAGE")
+			for ix, p := range analysis.Packages {
+				if topContributors > 0 && ix >= topContributors {
+					fmt.Printf("  ...and %d more\n", len(analysis.Packages)-ix)
+					break
+				}
+				fmt.Printf("%10s %10s  %s\n", formatBytes(p.Size), formatBytes(p.CompressedSize), p.Path)
+			}
+		}
+		fmt.Printf("\nTotal %s unzipped, %s zipped\n", formatBytes(analysis.Unzipped), formatBytes(analysis.Zipped))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(analyzeCmd)
+	addBundleFlags(analyzeCmd)
+	analyzeCmd.Flags().StringVar(&artifact, "artifact", "", "The path to an already built zip file to analyze instead of bundling the inputPath")
+	analyzeCmd.Flags().IntVar(&analyzeDepth, "depth", 2, "How many directories deep to print the tree")
+	analyzeCmd.Flags().IntVar(&topContributors, "top", 10, "How many of the largest npm packages to list, 0 for all of them")
+	analyzeCmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the analysis as JSON")
+	analyzeCmd.Flags().StringVar(&htmlOutput, "html", "", "Write a self-contained HTML treemap of the bundle to this path")
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fnzip "github.com/bbeesley/fn-push/pkg/zip"
+)
+
+func TestAnalyze(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{
+		"index.js",
+		"node_modules/a/index.js",
+		"node_modules/@s/b/index.js",
+	}))
+	setForTest(t, &include, []string{"**"})
+	setForTest(t, &exclude, []string{})
+	setForTest(t, &rootDir, "")
+
+	analysis := analyze(fnzip.CreateWithOptions(inputPath, functionOptions(exclude, io.Discard)), nil)
+	if analysis.Tree.Files != 3 || analysis.Unzipped != analysis.Tree.Size {
+		t.Fatalf("Unexpected tree: %+v", analysis.Tree)
+	}
+	if len(analysis.Packages) != 2 {
+		t.Fatalf("Expected 2 packages, got %v", analysis.Packages)
+	}
+
+	out := filepath.Join(t.TempDir(), "treemap.html")
+	writeTreemap(out, analysis)
+	html, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), `"path":"node_modules/@s/b"`) {
+		t.Fatalf("Expected the treemap to embed the analysis, got %s", html)
+	}
+}
+
+func TestAnalyzeWithLayerKey(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{
+		"index.js",
+		"node_modules/a/index.js",
+		"node_modules/@s/b/index.js",
+	}))
+	setForTest(t, &include, []string{"**"})
+	setForTest(t, &exclude, []string{})
+	setForTest(t, &rootDir, "")
+	setForTest(t, &lambdaRuntime, "node")
+	setForTest(t, &nodeLayoutName, "npm")
+	setForTest(t, &layerKey, "layers/deps")
+	setForTest(t, &symlinkNodeModules, true)
+	setForTest(t, &symlinkName, "node_modules")
+	setForTest(t, &symlinkTarget, "")
+
+	analysis := analyze(lambdaBundles(analyzeCmd.Flags(), io.Discard))
+	if len(analysis.Packages) != 2 {
+		t.Fatalf("Expected the packages in the layer, got %v", analysis.Packages)
+	}
+	for _, p := range analysis.Packages {
+		if !strings.HasPrefix(p.Path, "layers/deps.zip/") {
+			t.Fatalf("Expected %s to be listed under the layer zip", p.Path)
+		}
+	}
+	if analysis.Tree.Files != 4 || analysis.Unzipped != analysis.Tree.Size {
+		t.Fatalf("Expected the function and layer files in the tree, got %+v", analysis.Tree)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Builds the bucket key for an asset from its base key and the optional version suffix
+func keyName(key string, suffix string) string {
+	if suffix != "" {
+		return fmt.Sprintf("%s-%s.zip", key, suffix)
+	}
+	return fmt.Sprintf("%s.zip", key)
+}
+
+// Builds the bucket key for a layer from its base key and a hash of its contents, so functions with identical
+// dependencies share one object. The hash is joined with a dot rather than the dash keyName uses, so a shared layer
+// can never be mistaken for a version of the base key when pruning.
+func contentKeyName(key string, hash string) string {
+	return fmt.Sprintf("%s.sha256-%.16s.zip", key, hash)
+}
+
+// Reads a pre-built archive from disk so it can be uploaded without re-zipping
+func loadArtifact(path string) *bytes.Buffer {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read artifact '%s': %v", path, err)
+	}
+	_, err = zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		log.Fatalf("Artifact '%s' is not a valid zip archive: %v", path, err)
+	}
+	return bytes.NewBuffer(data)
+}
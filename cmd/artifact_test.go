@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyName(t *testing.T) {
+	if actual := keyName("fn/handler", ""); actual != "fn/handler.zip" {
+		t.Fatalf("Expected: fn/handler.zip, actual: %s", actual)
+	}
+	if actual := keyName("fn/handler", "1.2.3"); actual != "fn/handler-1.2.3.zip" {
+		t.Fatalf("Expected: fn/handler-1.2.3.zip, actual: %s", actual)
+	}
+}
+
+func TestContentKeyName(t *testing.T) {
+	if actual := contentKeyName("layers/deps", "0123456789abcdef0123"); actual != "layers/deps.sha256-0123456789abcdef.zip" {
+		t.Fatalf("Expected: layers/deps-0123456789abcdef.zip, actual: %s", actual)
+	}
+}
+
+func TestLoadArtifact(t *testing.T) {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	f, err := w.Create("index.js")
+	if err != nil {
+		t.Fatal("Error creating zip entry", err)
+	}
+	_, err = f.Write([]byte("exports.handler = async () => {}"))
+	if err != nil {
+		t.Fatal("Error writing zip entry", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal("Error closing zip writer", err)
+	}
+	path := filepath.Join(t.TempDir(), "bundle.zip")
+	err = os.WriteFile(path, b.Bytes(), 0644)
+	if err != nil {
+		t.Fatal("Error writing artifact", err)
+	}
+
+	artifactData := loadArtifact(path)
+	if !bytes.Equal(artifactData.Bytes(), b.Bytes()) {
+		t.Fatal("artifact contents were modified on load")
+	}
+}
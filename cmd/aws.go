@@ -24,18 +24,23 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/bbeesley/fn-push/pkg/zip"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bbeesley/fn-push/pkg/retention"
 	"github.com/spf13/cobra"
 )
 
-// Uploads a file to S3 to the given bucket and key from a buffer
-func S3Upload(region string, bucket string, keyName string, functionData *bytes.Buffer) {
+// Uploads a file to S3 to the given bucket and key from a buffer, returning the object's version id
+// if the bucket is versioned
+func S3Upload(region string, bucket string, keyName string, functionData *bytes.Buffer) string {
 	cfg, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
 		panic(err)
@@ -45,7 +50,7 @@ func S3Upload(region string, bucket string, keyName string, functionData *bytes.
 		o.Region = region
 	})
 
-	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+	output, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(keyName),
 		Body:   bytes.NewReader(functionData.Bytes()),
@@ -54,6 +59,124 @@ func S3Upload(region string, bucket string, keyName string, functionData *bytes.
 		log.Fatalf("failed to upload file '%s'", keyName)
 	}
 	fmt.Printf("Successfully uploaded %s to %s in %s\n", keyName, bucket, region)
+	return aws.ToString(output.VersionId)
+}
+
+// Lists the objects in an S3 bucket with keys starting with the given prefix
+func S3List(region string, bucket string, prefix string) []retention.Object {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.Region = region
+	})
+
+	var objects []retention.Object
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			log.Fatalf("failed to list objects in '%s': %v", bucket, err)
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, retention.Object{
+				Key:          aws.ToString(object.Key),
+				LastModified: aws.ToTime(object.LastModified),
+				Size:         aws.ToInt64(object.Size),
+			})
+		}
+	}
+	return objects
+}
+
+// Deletes a set of objects from an S3 bucket
+func S3Delete(region string, bucket string, keyNames []string) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.Region = region
+	})
+
+	// DeleteObjects accepts at most 1000 keys per request
+	for start := 0; start < len(keyNames); start += 1000 {
+		end := min(start+1000, len(keyNames))
+		var objects []types.ObjectIdentifier
+		for _, keyName := range keyNames[start:end] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(keyName)})
+		}
+		output, err := client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			log.Fatalf("failed to delete objects from '%s': %v", bucket, err)
+		}
+		for _, deleteError := range output.Errors {
+			log.Fatalf("failed to delete '%s' from '%s': %s", aws.ToString(deleteError.Key), bucket, aws.ToString(deleteError.Message))
+		}
+	}
+}
+
+// Checks whether an object exists in S3, returning its version id if the bucket is versioned
+func S3Exists(region string, bucket string, keyName string) (string, bool) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.Region = region
+	})
+
+	output, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(keyName),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return "", false
+	}
+	if err != nil {
+		log.Fatalf("failed to check for '%s' in '%s': %v", keyName, bucket, err)
+	}
+	return aws.ToString(output.VersionId), true
+}
+
+// Downloads an object from S3 into a buffer. An empty region uses the region from the AWS config.
+func S3Download(region string, bucket string, keyName string) *bytes.Buffer {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if region != "" {
+			o.Region = region
+		}
+	})
+
+	output, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(keyName),
+	})
+	if err != nil {
+		log.Fatalf("failed to download '%s' from '%s': %v", keyName, bucket, err)
+	}
+	defer output.Body.Close()
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(output.Body)
+	if err != nil {
+		log.Fatalf("failed to download '%s' from '%s': %v", keyName, bucket, err)
+	}
+	return buf
 }
 
 // awsCmd represents the aws command
@@ -64,39 +187,73 @@ var awsCmd = &cobra.Command{
 	for use in lambda functions. Optionally creates a file for
 	a layer as well as a file for the function itself.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		var functionKeyName string
-		if versionSuffix != "" {
-			functionKeyName = fmt.Sprintf("%s-%s.zip", functionKey, versionSuffix)
-		} else {
-			functionKeyName = fmt.Sprintf("%s.zip", functionKey)
+		functionKeyName := keyName(functionKey, versionSuffix)
+
+		applyPreset(cmd.Flags(), &lambdaRuntime)
+		if publish && updateFunction == "" {
+			log.Fatal("The --publish flag requires --update-function")
+		}
+		if alias != "" && updateFunction == "" {
+			log.Fatal("The --alias flag requires --update-function")
+		}
+		if alias != "" && !publish {
+			log.Fatal("The --alias flag requires --publish")
+		}
+		if publishLayer != "" && layerKey == "" {
+			log.Fatal("The --publish-layer flag requires --layerKey")
+		}
+		if updateFunctionLayers && (publishLayer == "" || updateFunction == "") {
+			log.Fatal("The --update-function-layers flag requires --publish-layer and --update-function")
+		}
+		if functionKey == "" && extensionName == "" {
+			log.Fatal("The --functionKey flag is required unless packaging an --extension")
+		}
+		if extensionName != "" {
+			if layerKey == "" {
+				log.Fatal("The --extension flag requires --layerKey to upload the extension layer to")
+			}
+			if functionKey != "" || artifact != "" || len(layerFlags) > 0 {
+				log.Fatal("The --extension flag builds a single layer, so it can't be combined with --functionKey, --artifact or --layer")
+			}
+			if updateFunction != "" && !updateFunctionLayers {
+				log.Fatal("The --extension flag can only be combined with --update-function to add the layer with --update-function-layers")
+			}
 		}
 
-		if layerKey == "" {
-			functionData := zip.Create(inputPath, include, exclude, rootDir, symlinkNodeModules, "")
-			for ix, region := range regions {
-				S3Upload(region, buckets[ix], functionKeyName, functionData)
+		var functionData *bytes.Buffer
+		var layers []layerZip
+		if artifact != "" {
+			if layerKey != "" {
+				log.Fatal("The --artifact flag cannot be combined with --layerKey")
 			}
+			functionData = loadArtifact(artifact)
 		} else {
-			functionExclude := exclude
-			layerRootDir := rootDir
-			if symlinkNodeModules {
-				functionExclude = append(functionExclude, "node_modules/**")
-				layerRootDir = "nodejs"
-				if nodeVersion != "" {
-					layerRootDir += fmt.Sprintf("/node%s", nodeVersion)
-				}
+			functionData, layers = lambdaBundles(cmd.Flags(), os.Stdout)
+		}
+
+		checkSizeLimits(lambdaLimits, functionData, layers)
+		layerKeyNames := make([]string, len(layers))
+		for ix, layer := range layers {
+			layerKeyNames[ix] = layerKeyName(layer)
+		}
+
+		for ix, region := range regions {
+			var functionVersion string
+			if functionData != nil {
+				functionVersion = S3Upload(region, buckets[ix], functionKeyName, functionData)
 			}
-			functionData := zip.Create(inputPath, include, functionExclude, rootDir, symlinkNodeModules, layerRootDir)
-			layerData := zip.Create(inputPath, []string{"node_modules/**"}, []string{}, layerRootDir, false, "")
-			var layerKeyName string
-			if versionSuffix != "" {
-				layerKeyName = fmt.Sprintf("%s-%s.zip", layerKey, versionSuffix)
-			} else {
-				layerKeyName = fmt.Sprintf("%s.zip", layerKey)
+			for layerIx, layer := range layers {
+				layerVersion := uploadLayer(region, buckets[ix], layerKeyNames[layerIx], layer.data)
+				// only the --layerKey layer is published, extra layers are left for whatever manages them
+				if publishLayer != "" && layer.key == layerKey {
+					layerVersionArn := LambdaPublishLayerVersion(region, publishLayer, buckets[ix], layerKeyNames[layerIx], layerVersion, layerRuntimes(lambdaRuntime, runtimeVersion()), layerArchitectures, layerLicense)
+					if updateFunctionLayers {
+						LambdaUpdateFunctionLayers(region, updateFunction, layerVersionArn, updateTimeout)
+					}
+				}
 			}
-			for ix, region := range regions {
-				S3Upload(region, buckets[ix], functionKeyName, functionData)
-				S3Upload(region, buckets[ix], layerKeyName, layerData)
+			if updateFunction != "" && functionData != nil {
+				LambdaUpdateFunctionCode(region, updateFunction, buckets[ix], functionKeyName, functionVersion, publish, alias, updateTimeout)
 			}
 		}
 	},
@@ -104,17 +261,25 @@ var awsCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(awsCmd)
-	awsCmd.Flags().StringVarP(&inputPath, "inputPath", "p", ".", "The path to the lambda code and node_modules")
-	awsCmd.Flags().StringArrayVarP(&include, "include", "i", []string{"**"}, "An array of globs defining what to bundle")
-	awsCmd.Flags().StringArrayVarP(&exclude, "exclude", "e", []string{}, "An array of globs defining what not to bundle")
-	awsCmd.Flags().StringVar(&rootDir, "rootDir", "", "An optional path within the zip to save the files to")
+	addBundleFlags(awsCmd)
 	awsCmd.Flags().StringArrayVarP(&regions, "regions", "r", []string{}, "A list of regions to upload the assets in")
 	awsCmd.Flags().StringArrayVarP(&buckets, "buckets", "b", []string{}, "A list of buckets to upload to (same order as the regions please")
 	awsCmd.Flags().StringVarP(&functionKey, "functionKey", "f", "", "The path/filename of the zip file in the bucket (you don't need to add the .zip extension, but remember to include a version string of some sort)")
-	awsCmd.Flags().StringVarP(&layerKey, "layerKey", "l", "", "Tells the module to split out the node modules into a zip that you can create a lambda layer from")
-	awsCmd.Flags().StringVar(&nodeVersion, "nodeVersion", "", "The node major version that your layer is using, eg 20")
+	awsCmd.Flags().StringVar(&extensionName, "extension", "", "Package a Lambda extension layer instead of a function, with the executable (--binary, or the file with this name in the inputPath) in extensions/<name> and the other files under the rootDir, which defaults to the name")
+	awsCmd.Flags().StringVar(&sizeLimitAction, "size-limit", "warn", "What to do when the package is bigger than Lambda allows, one of warn, fail or off")
+	awsCmd.Flags().IntVar(&topContributors, "top", 10, "How many of the largest files and directories to list when the package is too big")
+	awsCmd.Flags().BoolVar(&contentAddressedLayer, "content-addressed-layer", false, "Name the layer zip after a hash of its contents instead of the versionSuffix, and skip uploading it when a function sharing the same dependencies already has")
+	awsCmd.Flags().BoolVar(&useCache, "cache", false, "Reuse a previously built zip from the local cache when none of its files or build options have changed")
 	awsCmd.Flags().StringVarP(&versionSuffix, "versionSuffix", "v", "", "An optional string to append to layer and function keys to use as a version indicator")
-	awsCmd.Flags().BoolVarP(&symlinkNodeModules, "symlinkNodeModules", "n", false, "Should we create a symlink from the function directory to the layer node_modules?")
+	awsCmd.Flags().StringVar(&artifact, "artifact", "", "The path to an already built zip file to upload instead of bundling the inputPath")
+	awsCmd.Flags().StringVar(&updateFunction, "update-function", "", "The name of a lambda function to point at the uploaded code in each region")
+	awsCmd.Flags().BoolVar(&publish, "publish", false, "Publish a new version of the function after updating its code (requires --update-function)")
+	awsCmd.Flags().StringVar(&alias, "alias", "", "An alias to move to the newly published version (requires --publish and --update-function)")
+	awsCmd.Flags().StringVar(&publishLayer, "publish-layer", "", "The name of a lambda layer to publish a new version of from the layer zip in each region")
+	awsCmd.Flags().StringArrayVar(&layerArchitectures, "layer-architectures", []string{}, "The instruction set architectures the published layer is compatible with, eg x86_64 or arm64")
+	awsCmd.Flags().StringVar(&layerLicense, "layer-license", "", "License info to attach to the published layer, eg an SPDX identifier or a URL")
+	awsCmd.Flags().BoolVar(&updateFunctionLayers, "update-function-layers", false, "Swap the published layer version into the function's layer list (requires --update-function)")
+	awsCmd.Flags().DurationVar(&updateTimeout, "update-timeout", 5*time.Minute, "How long to wait for the function update to complete")
 
 	err := awsCmd.MarkFlagRequired("regions")
 	if err != nil {
@@ -124,8 +289,4 @@ func init() {
 	if err != nil {
 		log.Fatal("Failed to set buckets flag as required", err)
 	}
-	err = awsCmd.MarkFlagRequired("functionKey")
-	if err != nil {
-		log.Fatal("Failed to set functionKey flag as required", err)
-	}
 }
@@ -0,0 +1,436 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bbeesley/fn-push/pkg/cache"
+	"github.com/bbeesley/fn-push/pkg/clean"
+	"github.com/bbeesley/fn-push/pkg/nodedeps"
+	"github.com/bbeesley/fn-push/pkg/nodelayout"
+	"github.com/bbeesley/fn-push/pkg/preset"
+	"github.com/bbeesley/fn-push/pkg/zip"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Looks up one of the built in presets, which are known to exist
+func mustGetPreset(name string) preset.Preset {
+	p, err := preset.Get(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
+// Merges the selected preset's include/exclude defaults into the bundling flags, and uses it as the runtime unless
+// one was set explicitly. Runtime is the variable the command's --runtime flag is bound to, or nil when the command's
+// runtime isn't one of the presets, eg a Cloud Functions runtime.
+func applyPreset(flags *pflag.FlagSet, runtime *string) {
+	if presetName == "" {
+		return
+	}
+	p := mustGetPreset(presetName)
+	var userInclude []string
+	if flags.Changed("include") {
+		userInclude = include
+	}
+	include, exclude = p.Resolve(userInclude, exclude, overridePreset)
+	if runtime != nil && !flags.Changed("runtime") {
+		*runtime = p.Name
+	}
+}
+
+// Returns the names of the ignore files function bundles should honour
+func ignoreFiles() []string {
+	files := []string{".fnpushignore"}
+	if useGitignore {
+		files = append(files, ".gitignore")
+	}
+	return files
+}
+
+// Returns a filter which leaves devDependencies out of node_modules when only production dependencies are wanted
+func prodFilter() func(file string, size int64) bool {
+	if !prodOnly {
+		return nil
+	}
+	filter, err := nodedeps.Load(os.DirFS(inputPath))
+	if err != nil {
+		log.Fatalf("Failed to work out production dependencies: %v", err)
+	}
+	return func(file string, size int64) bool {
+		return filter.Include(file)
+	}
+}
+
+// Returns a filter which only keeps files every one of the given filters keeps, ignoring nil filters
+func combineFilters(filters ...func(file string, size int64) bool) func(file string, size int64) bool {
+	var active []func(file string, size int64) bool
+	for _, filter := range filters {
+		if filter != nil {
+			active = append(active, filter)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	return func(file string, size int64) bool {
+		for _, filter := range active {
+			if !filter(file, size) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Returns a cleaner which strips docs, tests, type definitions and so on out of node_modules, or nil if cleaning
+// wasn't requested
+func layerCleaner() *clean.Cleaner {
+	if !cleanLayer {
+		return nil
+	}
+	rules, err := clean.Rules(cleanSkip, cleanPatterns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return clean.New(rules)
+}
+
+// Writes how much each clean rule removed from the layer to out
+func printCleanReport(report []clean.Saving, out io.Writer) {
+	var totalFiles int
+	var totalBytes int64
+	for _, saving := range report {
+		fmt.Fprintf(out, "Clean rule %s removed %d files (%s)\n", saving.Rule, saving.Files, formatBytes(saving.Bytes))
+		totalFiles += saving.Files
+		totalBytes += saving.Bytes
+	}
+	fmt.Fprintf(out, "Cleaning removed %d files (%s) from the layer\n", totalFiles, formatBytes(totalBytes))
+}
+
+// Formats a number of bytes for humans, eg 1.5 MiB
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// Returns the local cache of built archives when --cache is set
+func buildCache() zip.Cache {
+	if !useCache {
+		return nil
+	}
+	c, err := cache.Default()
+	if err != nil {
+		log.Fatalf("Failed to find the cache directory: %v", err)
+	}
+	return c
+}
+
+// Returns the deflate level to build zips with from --compression-level, where 0 stores files without compressing them
+func zipCompressionLevel() int {
+	if compressionLevel < 0 || compressionLevel > 9 {
+		log.Fatalf("Invalid --compression-level %d, expected 0 (no compression) to 9 (smallest)", compressionLevel)
+	}
+	if compressionLevel == 0 {
+		return zip.NoCompression
+	}
+	return compressionLevel
+}
+
+// Returns the options for bundling the function code from the inputPath, writing progress messages to out
+func functionOptions(functionExclude []string, out io.Writer) zip.Options {
+	return zip.Options{
+		Include: include,
+		Exclude: functionExclude,
+		RootDir: rootDir,
+		Filter:  prodFilter(),
+
+		// node_modules is almost always in .gitignore, but without a layer it has to be in the function zip
+		IgnoreFiles:  ignoreFiles(),
+		IgnoreExempt: []string{"node_modules/**"},
+
+		CompressionLevel: zipCompressionLevel(),
+		Compressor:       compressor,
+		Store:            storePatterns,
+		Cache:            buildCache(),
+		Log:              out,
+
+		Symlinks:              zip.SymlinkPolicy(symlinkPolicy),
+		AllowExternalSymlinks: allowExternalSymlinks,
+	}
+}
+
+// Returns the options for bundling a layer's dependencies, which ignore files don't apply to, writing progress
+// messages to out
+func layerOptions(layerInclude []string, layerExclude []string, layerRootDir string, out io.Writer) zip.Options {
+	return zip.Options{
+		Include:          layerInclude,
+		Exclude:          layerExclude,
+		RootDir:          layerRootDir,
+		CompressionLevel: zipCompressionLevel(),
+		Compressor:       compressor,
+		Store:            storePatterns,
+		Cache:            buildCache(),
+		Log:              out,
+
+		Symlinks:              zip.SymlinkPolicy(symlinkPolicy),
+		AllowExternalSymlinks: allowExternalSymlinks,
+	}
+}
+
+// Works out how the node_modules in the inputPath were installed, from the --node-layout flag
+func nodeLayout() nodelayout.Layout {
+	switch layout := nodelayout.Layout(nodeLayoutName); layout {
+	case "auto":
+		return nodelayout.Detect(inputPath)
+	case nodelayout.NPM, nodelayout.PNPM, nodelayout.PnP:
+		return layout
+	default:
+		log.Fatalf("Unknown --node-layout '%s', expected auto, npm, pnpm or pnp", nodeLayoutName)
+		return ""
+	}
+}
+
+// Builds the entries for a flat node_modules from a pnpm or yarn plug'n'play install, keeping the files the filter
+// lets through
+func flatNodeModules(layout nodelayout.Layout, filter func(file string, size int64) bool, out io.Writer) []zip.Entry {
+	files, err := nodelayout.Materialize(inputPath, layout)
+	if err != nil {
+		log.Fatalf("Failed to build node_modules from the %s layout: %v", layout, err)
+	}
+	entries := make([]zip.Entry, 0, len(files))
+	for _, f := range files {
+		if filter != nil {
+			var size int64
+			if info, err := fs.Stat(f.FS, f.Path); err == nil {
+				size = info.Size()
+			}
+			if !filter(f.Name, size) {
+				continue
+			}
+		}
+		entries = append(entries, zip.Entry{FS: f.FS, Source: f.Path, Name: f.Name})
+	}
+	fmt.Fprintf(out, "Flattened %d files from the %s layout into node_modules\n", len(entries), layout)
+	return entries
+}
+
+// Returns where bundling progress messages go: stderr when the command prints JSON, so they don't get mixed up with
+// output meant for other programs
+func progressWriter() io.Writer {
+	if jsonOutput {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Bundles the function code from the inputPath the same way the aws command would, so layers split out with
+// --layerKey and --layer are left out and symlinks are added. Progress messages are written to out.
+func localBundle(flags *pflag.FlagSet, out io.Writer) *bytes.Buffer {
+	functionData, _ := lambdaBundles(flags, out)
+	return functionData
+}
+
+// Returns the version of the selected runtime
+func runtimeVersion() string {
+	switch lambdaRuntime {
+	case "node":
+		return nodeVersion
+	case "python":
+		return pythonVersion
+	}
+	return ""
+}
+
+// Bundles a function for a runtime which keeps its dependencies in a directory of its own, splitting them out
+// into a layer laid out the way the runtime expects when a layer key is set
+func runtimeBundles(out io.Writer) (*bytes.Buffer, *bytes.Buffer) {
+	layer := *mustGetPreset(lambdaRuntime).Layer
+	if lambdaRuntime == "python" {
+		layer.Source = sitePackages
+	}
+	functionExclude := append([]string{}, exclude...)
+	if lambdaRuntime == "python" {
+		functionExclude = append(functionExclude, layer.Exclude...)
+	}
+	if layerKey == "" {
+		return zip.CreateWithOptions(inputPath, functionOptions(functionExclude, out)), nil
+	}
+
+	if layer.Source != "" {
+		functionExclude = append(functionExclude, fmt.Sprintf("%s/**", filepath.ToSlash(filepath.Clean(layer.Source))))
+	} else {
+		functionExclude = append(functionExclude, layer.Include...)
+	}
+	functionData := zip.CreateWithOptions(inputPath, functionOptions(functionExclude, out))
+	layerData := zip.CreateWithOptions(filepath.Join(inputPath, layer.Source), layerOptions(layer.Include, layer.Exclude, layer.RootDir(runtimeVersion()), out))
+	return functionData, layerData
+}
+
+// Bundles a compiled go binary as the bootstrap executable for the provided.al2023 runtime, along with any
+// files explicitly included from the inputPath
+func goBundle(includeChanged bool, out io.Writer) *bytes.Buffer {
+	if binary == "" {
+		log.Fatal("The go runtime requires --binary")
+	}
+	functionInclude := []string{}
+	if includeChanged {
+		functionInclude = include
+	}
+	opts := functionOptions(append(append([]string{}, exclude...), "bootstrap"), out)
+	opts.Include = functionInclude
+	opts.Entries = []zip.Entry{{Source: binary, Name: "bootstrap", Mode: 0755}}
+	return zip.CreateWithOptions(inputPath, opts)
+}
+
+// Bundles the inputPath for Lambda the way the aws command uploads it, returning the function zip, which is nil
+// when packaging an extension, and any layer zips. Flags are the command's flags, to tell whether --include was set,
+// and progress messages are written to out.
+func lambdaBundles(flags *pflag.FlagSet, out io.Writer) (*bytes.Buffer, []layerZip) {
+	if !slices.Contains(preset.Names(), lambdaRuntime) {
+		log.Fatalf("Unknown runtime '%s', expected one of %s", lambdaRuntime, strings.Join(preset.Names(), ", "))
+	}
+	if lambdaRuntime == "go" && layerKey != "" && extensionName == "" {
+		log.Fatal("The go runtime doesn't support splitting out a layer with --layerKey")
+	}
+	extraLayers := mustParseLayerSpecs()
+	if len(extraLayers) > 0 && (lambdaRuntime != "node" || layerKey == "") {
+		log.Fatal("The --layer flag requires the node runtime and a --layerKey for the rest of node_modules")
+	}
+
+	includeChanged := flags.Changed("include") || presetName != ""
+	var functionData *bytes.Buffer
+	var layers []layerZip
+	if extensionName != "" {
+		extensionData := extensionBundle(includeChanged, out)
+		checkExtension(extensionData, extensionName)
+		layers = append(layers, layerZip{key: layerKey, data: extensionData})
+	} else if lambdaRuntime == "go" {
+		functionData = goBundle(includeChanged, out)
+	} else if lambdaRuntime != "node" {
+		var layerData *bytes.Buffer
+		functionData, layerData = runtimeBundles(out)
+		if layerData != nil {
+			layers = append(layers, layerZip{key: layerKey, data: layerData})
+		}
+	} else if layerKey == "" {
+		opts := functionOptions(exclude, out)
+		opts.Links = functionLinks(mustGetPreset("node").Layer.RootDir(nodeVersion))
+		functionData = zip.CreateWithOptions(inputPath, opts)
+	} else {
+		nodeLayer := mustGetPreset("node").Layer
+		// everything that goes in one of the extra layers is left out of the function and the main layer
+		functionExclude := append(append([]string{}, exclude...), layerIncludes(extraLayers)...)
+		layerRootDir := rootDir
+		layout := nodeLayout()
+		if symlinkNodeModules {
+			functionExclude = append(functionExclude, nodeLayer.Include...)
+			if layout == nodelayout.PnP {
+				// the packages yarn installed go in the layer's node_modules instead
+				functionExclude = append(functionExclude, ".yarn/**", ".pnp.*")
+			}
+			layerRootDir = nodeLayer.RootDir(nodeVersion)
+		}
+		opts := functionOptions(functionExclude, out)
+		opts.Links = functionLinks(layerRootDir)
+		functionData = zip.CreateWithOptions(inputPath, opts)
+		cleaner := layerCleaner()
+		layerOpts := layerOptions(nodeLayer.Include, nodeLayer.Exclude, layerRootDir, out)
+		layerOpts.Filter = prodFilter()
+		if cleaner != nil {
+			layerOpts.Filter = combineFilters(layerOpts.Filter, cleaner.Include)
+		}
+		var entries []zip.Entry
+		if layout != nodelayout.NPM {
+			// there's no flat node_modules on disk, so the layers are built from the packages the layout points at
+			entries = flatNodeModules(layout, layerOpts.Filter, out)
+		}
+		var extraLayerZips []layerZip
+		extraLayerZips, entries = buildExtraLayers(extraLayers, layerOpts, entries)
+		layerOpts.Exclude = append(append([]string{}, layerOpts.Exclude...), layerIncludes(extraLayers)...)
+		if layout != nodelayout.NPM {
+			layerOpts.Include = []string{}
+			layerOpts.Entries = entries
+		}
+		layers = append(layers, layerZip{key: layerKey, data: zip.CreateWithOptions(inputPath, layerOpts)})
+		layers = append(layers, extraLayerZips...)
+		if cleaner != nil {
+			printCleanReport(cleaner.Report(), out)
+		}
+		if err := checkLinkTargets(opts.Links, layerRootDir, layers); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return functionData, layers
+}
+
+// Adds the flags which control how the inputPath is bundled for Lambda, shared by the aws command and the commands
+// which rebuild the same bundle to inspect it
+func addBundleFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&inputPath, "inputPath", "p", ".", "The path to the lambda code and node_modules")
+	cmd.Flags().StringArrayVarP(&include, "include", "i", []string{"**"}, "An array of globs defining what to bundle")
+	cmd.Flags().StringArrayVarP(&exclude, "exclude", "e", []string{}, "An array of globs defining what not to bundle")
+	cmd.Flags().StringVar(&rootDir, "rootDir", "", "An optional path within the zip to save the files to")
+	cmd.Flags().StringVarP(&layerKey, "layerKey", "l", "", "Tells the module to split out the node modules into a zip that you can create a lambda layer from")
+	cmd.Flags().StringArrayVar(&layerFlags, "layer", []string{}, "An extra layer to split out of node_modules, as key=glob[,glob...], eg 'layers/sdk=node_modules/@aws-sdk/**,node_modules/sharp/**'. Each file goes in the first layer matching it, and the --layerKey layer gets the rest")
+	cmd.Flags().StringVar(&nodeVersion, "nodeVersion", "", "The node major version that your layer is using, eg 20")
+	cmd.Flags().StringVar(&lambdaRuntime, "runtime", "node", "The runtime the function is written for, one of go, java, node, python or ruby")
+	cmd.Flags().StringVar(&binary, "binary", "", "The compiled binary to package as the bootstrap executable when using the go runtime, or as the executable with --extension")
+	cmd.Flags().StringVar(&pythonVersion, "python-version", "", "The python version your layer is using, eg 3.12")
+	cmd.Flags().StringVar(&sitePackages, "site-packages", "package", "The directory within the inputPath that python dependencies were installed into, eg with pip install -t")
+	cmd.Flags().BoolVar(&prodOnly, "prod-only", false, "Only bundle the production dependencies in node_modules, as listed in package.json and the lockfile")
+	cmd.Flags().BoolVar(&cleanLayer, "clean", false, "Strip docs, tests, type definitions, source maps and other files not needed at runtime out of the node_modules layer")
+	cmd.Flags().StringArrayVar(&cleanSkip, "clean-skip", []string{}, "The names of clean rules to turn off (docs, tests, types, sourcemaps, examples or configs)")
+	cmd.Flags().StringArrayVar(&cleanPatterns, "clean-pattern", []string{}, "Extra globs, relative to node_modules, for the clean step to remove")
+	cmd.Flags().IntVar(&compressionLevel, "compression-level", 5, "The deflate level to compress files with, from 1 (fastest) to 9 (smallest), or 0 to store them without compressing")
+	cmd.Flags().StringVar(&compressor, "compressor", "deflate", "The compressor to deflate files with, deflate or huffman (much faster, but bigger zips)")
+	cmd.Flags().StringArrayVar(&storePatterns, "store", []string{}, "Globs matching files which are already compressed, eg '**/*.png', to store without compressing them again")
+	cmd.Flags().StringVar(&symlinkPolicy, "symlinks", "follow", "What to do with symlinks in the inputPath: follow them, preserve them as symlinks in the zip, or error")
+	cmd.Flags().BoolVar(&allowExternalSymlinks, "allow-external-symlinks", false, "Follow symlinks which point outside of the inputPath, eg to packages elsewhere in a monorepo")
+	cmd.Flags().StringVar(&nodeLayoutName, "node-layout", "auto", "How node_modules were installed: npm, pnpm, pnp (yarn plug'n'play), or auto to detect it. pnpm and pnp installs are flattened into a plain node_modules in the layer")
+	cmd.Flags().BoolVar(&useGitignore, "gitignore", false, "Leave files matched by .gitignore files out of the function zip (.fnpushignore files are always honoured)")
+	cmd.Flags().StringVar(&presetName, "preset", "", "A runtime preset (go, java, node, python or ruby) supplying default include/exclude globs and layer layout")
+	cmd.Flags().BoolVar(&overridePreset, "override-preset", false, "Replace the preset's excludes with the --exclude globs instead of adding to them")
+	cmd.Flags().BoolVarP(&symlinkNodeModules, "symlinkNodeModules", "n", false, "Should we create a symlink from the function directory to the layer node_modules?")
+	cmd.Flags().StringVar(&symlinkName, "symlink-name", "node_modules", "The name of the symlink --symlinkNodeModules adds to the function zip")
+	cmd.Flags().StringVar(&symlinkTarget, "symlink-target", "", "Where the --symlinkNodeModules symlink points, defaulting to the layer's root dir in /opt, eg /opt/nodejs or /opt/nodejs/node20 with --nodeVersion 20. Set it to eg /opt/nodejs/node_modules to point at the layer's node_modules instead")
+	cmd.Flags().StringArrayVar(&extraSymlinks, "extra-symlink", []string{}, "An extra symlink to add to the function zip, as name=target, eg 'bin=/opt/bin'. Can also be set with a symlinks list in the config file")
+}
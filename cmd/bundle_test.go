@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/bbeesley/fn-push/pkg/nodelayout"
+	fnzip "github.com/bbeesley/fn-push/pkg/zip"
+)
+
+// Sets a package variable, eg one bound to a flag, for the rest of the test and puts the old value back afterwards,
+// so tests don't depend on the order they run in
+func setForTest[T any](t *testing.T, variable *T, value T) {
+	t.Helper()
+	old := *variable
+	*variable = value
+	t.Cleanup(func() { *variable = old })
+}
+
+// Creates files (with placeholder content) in a temporary directory
+func writeTestTree(t *testing.T, files []string) string {
+	dir := t.TempDir()
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal("Error creating directory", err)
+		}
+		err = os.WriteFile(path, []byte(file), 0644)
+		if err != nil {
+			t.Fatal("Error writing file", err)
+		}
+	}
+	return dir
+}
+
+// Lists the names of the entries in a zip archive
+func zipEntryNames(t *testing.T, data *bytes.Buffer) []string {
+	r, err := zip.NewReader(bytes.NewReader(data.Bytes()), int64(data.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPythonBundles(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{
+		"handler.py",
+		"__pycache__/handler.cpython-312.pyc",
+		"package/requests/__init__.py",
+		"package/requests/__pycache__/api.cpython-312.pyc",
+	}))
+	setForTest(t, &include, []string{"**"})
+	setForTest(t, &exclude, []string{})
+	setForTest(t, &rootDir, "")
+	setForTest(t, &layerKey, "layer")
+	setForTest(t, &pythonVersion, "3.12")
+	setForTest(t, &sitePackages, "package")
+
+	setForTest(t, &lambdaRuntime, "python")
+
+	functionData, layerData := runtimeBundles(io.Discard)
+
+	functionFiles := zipEntryNames(t, functionData)
+	if len(functionFiles) != 1 || functionFiles[0] != "handler.py" {
+		t.Fatalf("Unexpected function files: %v", functionFiles)
+	}
+	layerFiles := zipEntryNames(t, layerData)
+	if len(layerFiles) != 1 || layerFiles[0] != "python/lib/python3.12/site-packages/requests/__init__.py" {
+		t.Fatalf("Unexpected layer files: %v", layerFiles)
+	}
+}
+
+func TestGoBundle(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{"main.go", "config/settings.json", "bin/handler"}))
+	setForTest(t, &include, []string{"config/**"})
+	setForTest(t, &exclude, []string{})
+	setForTest(t, &rootDir, "")
+	setForTest(t, &binary, filepath.Join(inputPath, "bin", "handler"))
+
+	functionFiles := zipEntryNames(t, goBundle(true, io.Discard))
+	if len(functionFiles) != 2 || functionFiles[0] != "bootstrap" || functionFiles[1] != "config/settings.json" {
+		t.Fatalf("Unexpected function files: %v", functionFiles)
+	}
+
+	functionFiles = zipEntryNames(t, goBundle(false, io.Discard))
+	if len(functionFiles) != 1 || functionFiles[0] != "bootstrap" {
+		t.Fatalf("Unexpected function files: %v", functionFiles)
+	}
+}
+
+func TestApplyPreset(t *testing.T) {
+	setForTest(t, &include, []string{"**"})
+	setForTest(t, &exclude, []string{"**/*.snap"})
+	setForTest(t, &lambdaRuntime, "node")
+	setForTest(t, &presetName, "python")
+
+	setForTest(t, &functionRuntime, "")
+	applyPreset(gcpCmd.Flags(), nil)
+	if lambdaRuntime != "node" || functionRuntime != "" {
+		t.Fatalf("Expected the gcp preset to leave the runtimes alone, got %s and %s", lambdaRuntime, functionRuntime)
+	}
+
+	setForTest(t, &include, []string{"**"})
+	setForTest(t, &exclude, []string{"**/*.snap"})
+	applyPreset(awsCmd.Flags(), &lambdaRuntime)
+	if lambdaRuntime != "python" {
+		t.Fatalf("Expected: python, actual: %s", lambdaRuntime)
+	}
+	if len(include) != 1 || include[0] != "**" {
+		t.Fatalf("Unexpected include: %v", include)
+	}
+	if exclude[0] != "**/__pycache__/**" || exclude[len(exclude)-1] != "**/*.snap" {
+		t.Fatalf("Unexpected exclude: %v", exclude)
+	}
+}
+
+func TestProdOnly(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{
+		"index.js",
+		"node_modules/a/index.js",
+		"node_modules/jest/index.js",
+	}))
+	err := os.WriteFile(filepath.Join(inputPath, "package-lock.json"), []byte(`{
+		"lockfileVersion": 3,
+		"packages": {
+			"node_modules/a": {"version": "1.0.0"},
+			"node_modules/jest": {"version": "29.0.0", "dev": true}
+		}
+	}`), 0644)
+	if err != nil {
+		t.Fatal("Error writing lockfile", err)
+	}
+	setForTest(t, &include, []string{"**"})
+	setForTest(t, &exclude, []string{"package-lock.json"})
+	setForTest(t, &rootDir, "")
+	setForTest(t, &prodOnly, true)
+
+	functionFiles := zipEntryNames(t, fnzip.CreateWithOptions(inputPath, functionOptions(exclude, io.Discard)))
+	if len(functionFiles) != 2 || functionFiles[0] != "index.js" || functionFiles[1] != "node_modules/a/index.js" {
+		t.Fatalf("Unexpected function files: %v", functionFiles)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		512:             "512 B",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+	}
+	for size, expected := range cases {
+		if actual := formatBytes(size); actual != expected {
+			t.Fatalf("Expected %s for %d bytes, got %s", expected, size, actual)
+		}
+	}
+}
+
+func TestCleanFilter(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{
+		"node_modules/a/index.js",
+		"node_modules/a/README.md",
+		"node_modules/a/index.d.ts",
+	}))
+	setForTest(t, &cleanLayer, true)
+	setForTest(t, &cleanSkip, []string{"types"})
+
+	cleaner := layerCleaner()
+	layerFiles := zipEntryNames(t, fnzip.CreateWithOptions(inputPath, fnzip.Options{
+		Include: []string{"node_modules/**"},
+		Filter:  combineFilters(nil, cleaner.Include),
+	}))
+	if len(layerFiles) != 2 || layerFiles[0] != "node_modules/a/index.d.ts" || layerFiles[1] != "node_modules/a/index.js" {
+		t.Fatalf("Unexpected layer files: %v", layerFiles)
+	}
+	report := cleaner.Report()
+	if len(report) != 1 || report[0].Rule != "docs" || report[0].Files != 1 || report[0].Bytes != int64(len("node_modules/a/README.md")) {
+		t.Fatalf("Unexpected report: %v", report)
+	}
+}
+
+func TestFlatNodeModules(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{
+		"node_modules/.pnpm/a@1.0.0/node_modules/a/index.js",
+		"node_modules/.pnpm/a@1.0.0/node_modules/a/README.md",
+	}))
+	if err := os.Symlink(".pnpm/a@1.0.0/node_modules/a", filepath.Join(inputPath, "node_modules", "a")); err != nil {
+		t.Fatal("Error creating symlink", err)
+	}
+	setForTest(t, &nodeLayoutName, "auto")
+	setForTest(t, &cleanLayer, true)
+	setForTest(t, &cleanSkip, []string{})
+
+	layout := nodeLayout()
+	if layout != nodelayout.PNPM {
+		t.Fatal("Expected the pnpm layout to be detected, got", layout)
+	}
+	cleaner := layerCleaner()
+	entries := flatNodeModules(layout, cleaner.Include, io.Discard)
+	layerFiles := zipEntryNames(t, fnzip.CreateWithOptions(inputPath, fnzip.Options{
+		Include: []string{},
+		RootDir: "nodejs",
+		Entries: entries,
+	}))
+	if len(layerFiles) != 1 || layerFiles[0] != "nodejs/node_modules/a/index.js" {
+		t.Fatalf("Unexpected layer files: %v", layerFiles)
+	}
+	// the README's size comes from where pnpm installed it, not the flattened path
+	report := cleaner.Report()
+	if len(report) != 1 || report[0].Bytes != int64(len("node_modules/.pnpm/a@1.0.0/node_modules/a/README.md")) {
+		t.Fatalf("Unexpected report: %v", report)
+	}
+}
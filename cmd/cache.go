@@ -0,0 +1,105 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bbeesley/fn-push/pkg/cache"
+	"github.com/spf13/cobra"
+)
+
+var cacheMaxAge time.Duration
+
+// Opens the default cache, failing if there's no cache directory
+func mustGetCache() *cache.Cache {
+	c, err := cache.Default()
+	if err != nil {
+		log.Fatalf("Failed to find the cache directory: %v", err)
+	}
+	return c
+}
+
+// cacheCmd represents the cache command
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the local cache of built zips",
+	Long: `The aws and gcp commands keep the zips they build in a local
+	cache when run with --cache, so an unchanged function or layer isn't
+	compressed again on the next push. The cache lives in fn-push in your
+	user cache directory, eg $XDG_CACHE_HOME/fn-push.`,
+}
+
+// cacheLsCmd represents the cache ls command
+var cacheLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the zips in the cache",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustGetCache()
+		entries, err := c.List()
+		if err != nil {
+			log.Fatalf("Failed to list the cache: %v", err)
+		}
+		if jsonOutput {
+			if entries == nil {
+				entries = []cache.Entry{}
+			}
+			printJSON(entries)
+			return
+		}
+		var total int64
+		for _, entry := range entries {
+			fmt.Printf("%.12s %10s  last used %s\n", entry.Key, formatBytes(entry.Size), entry.LastUsed.Format(time.RFC3339))
+			total += entry.Size
+		}
+		fmt.Printf("%d zips (%s) in %s\n", len(entries), formatBytes(total), c.Dir)
+	},
+}
+
+// cacheCleanCmd represents the cache clean command
+var cacheCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove zips from the cache",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		removed, err := mustGetCache().Clean(cacheMaxAge, time.Now())
+		if err != nil {
+			log.Fatalf("Failed to clean the cache: %v", err)
+		}
+		var total int64
+		for _, entry := range removed {
+			total += entry.Size
+		}
+		fmt.Printf("Removed %d zips (%s) from the cache\n", len(removed), formatBytes(total))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheLsCmd)
+	cacheCmd.AddCommand(cacheCleanCmd)
+	cacheLsCmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the cached zips as JSON")
+	cacheCleanCmd.Flags().DurationVar(&cacheMaxAge, "older-than", 0, "Only remove zips which haven't been used for this long, eg 168h (removes everything by default)")
+}
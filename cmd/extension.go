@@ -0,0 +1,129 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	fnzip "github.com/bbeesley/fn-push/pkg/zip"
+)
+
+// Bundles a Lambda extension as a layer: the executable goes in extensions/<name>, where Lambda looks for
+// extensions to start, and the files it needs go under the rootDir, which defaults to the extension's name. Progress
+// messages are written to out.
+func extensionBundle(includeChanged bool, out io.Writer) *bytes.Buffer {
+	if extensionName == "" || extensionName == "." || extensionName == ".." || strings.ContainsAny(extensionName, `/\`) {
+		log.Fatalf("Invalid --extension '%s', expected a file name like my-extension", extensionName)
+	}
+	executable := binary
+	if executable == "" {
+		executable = filepath.Join(inputPath, extensionName)
+	}
+	info, err := os.Stat(executable)
+	if err != nil || info.IsDir() {
+		log.Fatalf("Couldn't find the extension executable '%s', pass its path with --binary", executable)
+	}
+
+	// the executable is already in the zip, and nothing else can go in extensions/ or Lambda would try to run it
+	extensionExclude := append(append([]string{}, exclude...), "extensions/**")
+	if rel, err := filepath.Rel(inputPath, executable); err == nil && !strings.HasPrefix(rel, "..") {
+		extensionExclude = append(extensionExclude, filepath.ToSlash(rel))
+	}
+	opts := functionOptions(extensionExclude, out)
+	if lambdaRuntime == "go" && !includeChanged {
+		// a compiled extension doesn't need anything else unless files are explicitly included
+		opts.Include = []string{}
+	}
+	if opts.RootDir == "" {
+		opts.RootDir = extensionName
+	}
+	opts.Entries = []fnzip.Entry{{Source: executable, Name: "extensions/" + extensionName, Mode: 0755, AtRoot: true}}
+	return fnzip.CreateWithOptions(inputPath, opts)
+}
+
+// Lists the ways a layer zip won't work as the named Lambda extension. Lambda starts every file directly in
+// extensions/, so they all have to be executables, and the named one has to be there.
+func extensionProblems(data []byte, name string) ([]string, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	found := false
+	for _, f := range r.File {
+		file, ok := strings.CutPrefix(f.Name, "extensions/")
+		if !ok || file == "" {
+			continue
+		}
+		if f.FileInfo().IsDir() || strings.Contains(file, "/") {
+			problems = append(problems, fmt.Sprintf("%s is in a subdirectory, but Lambda only starts files directly in extensions/", f.Name))
+			continue
+		}
+		if f.Mode().Perm()&0111 != 0111 {
+			problems = append(problems, fmt.Sprintf("%s has mode %v, but extensions have to be executable", f.Name, f.Mode().Perm()))
+		}
+		if file != name {
+			continue
+		}
+		found = true
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		header := make([]byte, 4)
+		n, err := io.ReadFull(rc, header)
+		rc.Close()
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		header = header[:n]
+		if !bytes.HasPrefix(header, []byte("\x7fELF")) && !bytes.HasPrefix(header, []byte("#!")) {
+			problems = append(problems, fmt.Sprintf("%s isn't a Linux executable or a script starting with #!", f.Name))
+		}
+	}
+	if !found {
+		problems = append(problems, fmt.Sprintf("there's no extensions/%s executable", name))
+	}
+	return problems, nil
+}
+
+// Checks the extension layer before it's uploaded, failing with everything that's wrong with it
+func checkExtension(data *bytes.Buffer, name string) {
+	problems, err := extensionProblems(data.Bytes(), name)
+	if err != nil {
+		log.Fatalf("Failed to read extension zip: %v", err)
+	}
+	if len(problems) == 0 {
+		return
+	}
+	for _, problem := range problems {
+		fmt.Printf("Invalid extension: %s\n", problem)
+	}
+	log.Fatalf("The %s extension layer isn't valid", name)
+}
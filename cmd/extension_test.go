@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtensionBundle(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{
+		"index.js",
+		"node_modules/a/index.js",
+		"extensions/stale",
+	}))
+	if err := os.WriteFile(filepath.Join(inputPath, "my-extension"), []byte("#!/bin/sh\nexec node /opt/my-extension/index.js\n"), 0644); err != nil {
+		t.Fatal("Error writing file", err)
+	}
+	setForTest(t, &include, []string{"**"})
+	setForTest(t, &exclude, []string{})
+	setForTest(t, &rootDir, "")
+	setForTest(t, &binary, "")
+	setForTest(t, &lambdaRuntime, "node")
+	setForTest(t, &extensionName, "my-extension")
+
+	data := extensionBundle(false, io.Discard)
+	files := zipEntryNames(t, data)
+	expected := []string{"extensions/my-extension", "my-extension/index.js", "my-extension/node_modules/a/index.js"}
+	if strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v, got %v", expected, files)
+	}
+	problems, err := extensionProblems(data.Bytes(), extensionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatal("Expected a valid extension, got", problems)
+	}
+}
+
+func TestExtensionProblems(t *testing.T) {
+	build := func(files map[string]os.FileMode) []byte {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		for name, mode := range files {
+			header := &zip.FileHeader{Name: name}
+			header.SetMode(mode)
+			f, err := w.CreateHeader(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasSuffix(name, ".bin") {
+				f.Write([]byte("\x7fELF..."))
+			} else if !mode.IsDir() {
+				f.Write([]byte("not a script"))
+			}
+		}
+		w.Close()
+		return buf.Bytes()
+	}
+	cases := map[string]struct {
+		files    map[string]os.FileMode
+		problems []string
+	}{
+		"valid": {
+			files: map[string]os.FileMode{"extensions/ext.bin": 0755, "ext.bin/lib.so": 0644},
+		},
+		"missing": {
+			files:    map[string]os.FileMode{"ext.bin/lib.so": 0644},
+			problems: []string{"no extensions/ext.bin executable"},
+		},
+		"not executable": {
+			files:    map[string]os.FileMode{"extensions/ext.bin": 0644},
+			problems: []string{"has mode -rw-r--r--"},
+		},
+		"other extensions": {
+			files: map[string]os.FileMode{"extensions/ext.bin": 0755, "extensions/other": 0755},
+		},
+		"nested": {
+			files:    map[string]os.FileMode{"extensions/ext.bin": 0755, "extensions/lib/": os.ModeDir | 0755, "extensions/lib/helper": 0755},
+			problems: []string{"extensions/lib/ is in a subdirectory", "extensions/lib/helper is in a subdirectory"},
+		},
+	}
+	for name, c := range cases {
+		problems, err := extensionProblems(build(c.files), "ext.bin")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(problems) != len(c.problems) {
+			t.Fatalf("%s: expected %v, got %v", name, c.problems, problems)
+		}
+		for _, expected := range c.problems {
+			if !strings.Contains(strings.Join(problems, "\n"), expected) {
+				t.Fatalf("%s: expected a problem containing %q, got %v", name, expected, problems)
+			}
+		}
+	}
+
+	script := build(map[string]os.FileMode{"extensions/ext": 0755})
+	if problems, _ := extensionProblems(script, "ext"); len(problems) != 1 || !strings.Contains(problems[0], "isn't a Linux executable") {
+		t.Fatal("Expected a problem with an executable that isn't a binary or script, got", problems)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	functions "cloud.google.com/go/functions/apiv2"
+	"cloud.google.com/go/functions/apiv2/functionspb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// Points a Cloud Function at an uploaded source object, creating the function if it doesn't exist yet,
+// and waits for the deployment to complete
+func CloudFunctionDeploy(project string, location string, functionName string, bucket string, keyName string, generation int64, runtime string, entryPoint string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client, err := functions.NewFunctionClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	function, err := deployFunction(ctx, client, project, location, functionName, bucket, keyName, generation, runtime, entryPoint)
+	if err != nil {
+		log.Fatalf("Failed to deploy function '%s': %v", functionName, err)
+	}
+	fmt.Printf("Successfully deployed %s from %s/%s (generation %d)\n", function.GetName(), bucket, keyName, generation)
+}
+
+func deployFunction(ctx context.Context, client *functions.FunctionClient, project string, location string, functionName string, bucket string, keyName string, generation int64, runtime string, entryPoint string) (*functionspb.Function, error) {
+	parent := fmt.Sprintf("projects/%s/locations/%s", project, location)
+	name := fmt.Sprintf("%s/functions/%s", parent, functionName)
+	source := &functionspb.Source{
+		Source: &functionspb.Source_StorageSource{
+			StorageSource: &functionspb.StorageSource{
+				Bucket:     bucket,
+				Object:     keyName,
+				Generation: generation,
+			},
+		},
+	}
+
+	function, err := client.GetFunction(ctx, &functionspb.GetFunctionRequest{Name: name})
+	if status.Code(err) == codes.NotFound {
+		if runtime == "" || entryPoint == "" {
+			return nil, fmt.Errorf("function %s does not exist, --runtime and --entry-point are required to create it", name)
+		}
+		op, err := client.CreateFunction(ctx, &functionspb.CreateFunctionRequest{
+			Parent:     parent,
+			FunctionId: functionName,
+			Function: &functionspb.Function{
+				Name: name,
+				BuildConfig: &functionspb.BuildConfig{
+					Runtime:    runtime,
+					EntryPoint: entryPoint,
+					Source:     source,
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return op.Wait(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if function.BuildConfig == nil {
+		function.BuildConfig = &functionspb.BuildConfig{}
+	}
+	function.BuildConfig.Source = source
+	paths := []string{"build_config.source"}
+	if runtime != "" {
+		function.BuildConfig.Runtime = runtime
+		paths = append(paths, "build_config.runtime")
+	}
+	if entryPoint != "" {
+		function.BuildConfig.EntryPoint = entryPoint
+		paths = append(paths, "build_config.entry_point")
+	}
+	op, err := client.UpdateFunction(ctx, &functionspb.UpdateFunctionRequest{
+		Function:   function,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return op.Wait(ctx)
+}
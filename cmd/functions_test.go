@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	functions "cloud.google.com/go/functions/apiv2"
+	"cloud.google.com/go/functions/apiv2/functionspb"
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+type fakeFunctionService struct {
+	functionspb.UnimplementedFunctionServiceServer
+	existing *functionspb.Function
+	created  *functionspb.CreateFunctionRequest
+	updated  *functionspb.UpdateFunctionRequest
+}
+
+func (s *fakeFunctionService) GetFunction(ctx context.Context, req *functionspb.GetFunctionRequest) (*functionspb.Function, error) {
+	if s.existing == nil {
+		return nil, status.Error(codes.NotFound, "function not found")
+	}
+	return s.existing, nil
+}
+
+func (s *fakeFunctionService) CreateFunction(ctx context.Context, req *functionspb.CreateFunctionRequest) (*longrunningpb.Operation, error) {
+	s.created = req
+	return completedOperation(req.Function)
+}
+
+func (s *fakeFunctionService) UpdateFunction(ctx context.Context, req *functionspb.UpdateFunctionRequest) (*longrunningpb.Operation, error) {
+	s.updated = req
+	return completedOperation(req.Function)
+}
+
+func completedOperation(function *functionspb.Function) (*longrunningpb.Operation, error) {
+	response, err := anypb.New(function)
+	if err != nil {
+		return nil, err
+	}
+	return &longrunningpb.Operation{
+		Name:   "operations/deploy",
+		Done:   true,
+		Result: &longrunningpb.Operation_Response{Response: response},
+	}, nil
+}
+
+// Starts a local grpc server for the fake and returns a client connected to it
+func newFakeFunctionClient(t *testing.T, service *fakeFunctionService) *functions.FunctionClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error starting listener", err)
+	}
+	server := grpc.NewServer()
+	functionspb.RegisterFunctionServiceServer(server, service)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	client, err := functions.NewFunctionClient(context.Background(),
+		option.WithEndpoint(listener.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		t.Fatal("Error creating client", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestDeployFunctionCreatesMissingFunction(t *testing.T) {
+	service := &fakeFunctionService{}
+	client := newFakeFunctionClient(t, service)
+
+	function, err := deployFunction(context.Background(), client, "my-project", "europe-west2", "my-fn", "my-bucket", "fn/handler.zip", 42, "nodejs20", "handler")
+	if err != nil {
+		t.Fatal("Error deploying function", err)
+	}
+	if function.GetName() != "projects/my-project/locations/europe-west2/functions/my-fn" {
+		t.Fatalf("Unexpected function name: %s", function.GetName())
+	}
+	if service.created == nil || service.created.Parent != "projects/my-project/locations/europe-west2" || service.created.FunctionId != "my-fn" {
+		t.Fatalf("Unexpected create request: %v", service.created)
+	}
+	buildConfig := service.created.Function.BuildConfig
+	storageSource := buildConfig.Source.GetStorageSource()
+	if buildConfig.Runtime != "nodejs20" || buildConfig.EntryPoint != "handler" || storageSource.Bucket != "my-bucket" || storageSource.Object != "fn/handler.zip" || storageSource.Generation != 42 {
+		t.Fatalf("Unexpected build config: %v", buildConfig)
+	}
+}
+
+func TestDeployFunctionRequiresRuntimeToCreate(t *testing.T) {
+	service := &fakeFunctionService{}
+	client := newFakeFunctionClient(t, service)
+
+	_, err := deployFunction(context.Background(), client, "my-project", "europe-west2", "my-fn", "my-bucket", "fn/handler.zip", 42, "", "")
+	if err == nil {
+		t.Fatal("Expected an error when creating a function without a runtime")
+	}
+	if service.created != nil {
+		t.Fatal("Function should not have been created")
+	}
+}
+
+func TestDeployFunctionUpdatesSource(t *testing.T) {
+	service := &fakeFunctionService{
+		existing: &functionspb.Function{
+			Name: "projects/my-project/locations/europe-west2/functions/my-fn",
+			BuildConfig: &functionspb.BuildConfig{
+				Runtime:    "nodejs20",
+				EntryPoint: "handler",
+			},
+		},
+	}
+	client := newFakeFunctionClient(t, service)
+
+	_, err := deployFunction(context.Background(), client, "my-project", "europe-west2", "my-fn", "my-bucket", "fn/handler-2.zip", 43, "", "")
+	if err != nil {
+		t.Fatal("Error deploying function", err)
+	}
+	if service.updated == nil {
+		t.Fatal("Function was not updated")
+	}
+	paths := service.updated.UpdateMask.Paths
+	if len(paths) != 1 || paths[0] != "build_config.source" {
+		t.Fatalf("Unexpected update mask: %v", paths)
+	}
+	storageSource := service.updated.Function.BuildConfig.Source.GetStorageSource()
+	if storageSource.Object != "fn/handler-2.zip" || storageSource.Generation != 43 {
+		t.Fatalf("Unexpected storage source: %v", storageSource)
+	}
+	if service.updated.Function.BuildConfig.Runtime != "nodejs20" {
+		t.Fatalf("Runtime should be left as is, actual: %s", service.updated.Function.BuildConfig.Runtime)
+	}
+}
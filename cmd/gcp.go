@@ -27,15 +27,20 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 
+	"github.com/bbeesley/fn-push/pkg/retention"
 	"github.com/bbeesley/fn-push/pkg/zip"
 	"github.com/spf13/cobra"
 )
 
-// Uploads a file to Google Cloud Storage to the given bucket and key from a buffer
-func StorageUpload(bucket string, keyName string, functionData *bytes.Buffer) {
+// Uploads a file to Google Cloud Storage to the given bucket and key from a buffer, returning the
+// generation of the new object
+func StorageUpload(bucket string, keyName string, functionData *bytes.Buffer) int64 {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
 	if err != nil {
@@ -54,6 +59,74 @@ func StorageUpload(bucket string, keyName string, functionData *bytes.Buffer) {
 		log.Fatalf("Writer.Close: %v", err)
 	}
 	fmt.Printf("Successfully uploaded %s to %s\n", keyName, bucket)
+	return wc.Attrs().Generation
+}
+
+// Lists the objects in a Cloud Storage bucket with names starting with the given prefix
+func StorageList(bucket string, prefix string) []retention.Object {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	var objects []retention.Object
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Failed to list objects in '%s': %v", bucket, err)
+		}
+		objects = append(objects, retention.Object{
+			Key:          attrs.Name,
+			LastModified: attrs.Updated,
+			Size:         attrs.Size,
+		})
+	}
+	return objects
+}
+
+// Deletes a set of objects from a Cloud Storage bucket
+func StorageDelete(bucket string, keyNames []string) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	for _, keyName := range keyNames {
+		err = client.Bucket(bucket).Object(keyName).Delete(ctx)
+		if err != nil {
+			log.Fatalf("Failed to delete '%s' from '%s': %v", keyName, bucket, err)
+		}
+	}
+}
+
+// Downloads an object from Cloud Storage into a buffer
+func StorageDownload(bucket string, keyName string) *bytes.Buffer {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	rc, err := client.Bucket(bucket).Object(keyName).NewReader(ctx)
+	if err != nil {
+		log.Fatalf("Failed to download '%s' from '%s': %v", keyName, bucket, err)
+	}
+	defer rc.Close()
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(rc)
+	if err != nil {
+		log.Fatalf("Failed to download '%s' from '%s': %v", keyName, bucket, err)
+	}
+	return buf
 }
 
 // gcpCmd represents the gcp command
@@ -63,16 +136,22 @@ var gcpCmd = &cobra.Command{
 	Long: `Zips up function assets and uploads them to Google
 	Cloud Storage for use in Cloud Functions.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		functionData := zip.Create(inputPath, include, exclude, rootDir, symlinkNodeModules, "")
-		ctx := context.Background()
+		if deployFunctionName != "" && (project == "" || functionRegion == "") {
+			log.Fatal("The --deploy-function flag requires --project and --function-region")
+		}
+
+		applyPreset(cmd.Flags(), nil)
 
-		// Sets your Google Cloud Platform project ID.
-		var functionKeyName string
-		if versionSuffix != "" {
-			functionKeyName = fmt.Sprintf("%s-%s.zip", functionKey, versionSuffix)
+		var functionData *bytes.Buffer
+		if artifact != "" {
+			functionData = loadArtifact(artifact)
 		} else {
-			functionKeyName = fmt.Sprintf("%s.zip", functionKey)
+			functionData = zip.CreateWithOptions(inputPath, functionOptions(exclude, os.Stdout))
 		}
+		checkSizeLimits(cloudFunctionLimits, functionData, nil)
+		ctx := context.Background()
+
+		functionKeyName := keyName(functionKey, versionSuffix)
 
 		// Creates a client.
 		client, err := storage.NewClient(ctx)
@@ -80,8 +159,12 @@ var gcpCmd = &cobra.Command{
 			log.Fatalf("Failed to create client: %v", err)
 		}
 		defer client.Close()
-		for _, bucketName := range buckets {
-			StorageUpload(bucketName, functionKeyName, functionData)
+		generations := make([]int64, len(buckets))
+		for ix, bucketName := range buckets {
+			generations[ix] = StorageUpload(bucketName, functionKeyName, functionData)
+		}
+		if deployFunctionName != "" {
+			CloudFunctionDeploy(project, functionRegion, deployFunctionName, buckets[0], functionKeyName, generations[0], functionRuntime, entryPoint, deployTimeout)
 		}
 	},
 }
@@ -95,7 +178,26 @@ func init() {
 	gcpCmd.Flags().StringVar(&rootDir, "rootDir", "", "An optional path within the zip to save the files to")
 	gcpCmd.Flags().StringArrayVarP(&buckets, "buckets", "b", []string{}, "A list of buckets to upload to (same order as the regions please")
 	gcpCmd.Flags().StringVarP(&functionKey, "functionKey", "f", "", "The path/filename of the zip file in the bucket (you don't need to add the .zip extension, but remember to include a version string of some sort)")
+	gcpCmd.Flags().BoolVar(&prodOnly, "prod-only", false, "Only bundle the production dependencies in node_modules, as listed in package.json and the lockfile")
+	gcpCmd.Flags().IntVar(&compressionLevel, "compression-level", 5, "The deflate level to compress files with, from 1 (fastest) to 9 (smallest), or 0 to store them without compressing")
+	gcpCmd.Flags().StringVar(&compressor, "compressor", "deflate", "The compressor to deflate files with, deflate or huffman (much faster, but bigger zips)")
+	gcpCmd.Flags().StringArrayVar(&storePatterns, "store", []string{}, "Globs matching files which are already compressed, eg '**/*.png', to store without compressing them again")
+	gcpCmd.Flags().BoolVar(&useCache, "cache", false, "Reuse a previously built zip from the local cache when none of its files or build options have changed")
+	gcpCmd.Flags().StringVar(&symlinkPolicy, "symlinks", "follow", "What to do with symlinks in the inputPath: follow them, preserve them as symlinks in the zip, or error")
+	gcpCmd.Flags().BoolVar(&allowExternalSymlinks, "allow-external-symlinks", false, "Follow symlinks which point outside of the inputPath, eg to packages elsewhere in a monorepo")
+	gcpCmd.Flags().BoolVar(&useGitignore, "gitignore", false, "Leave files matched by .gitignore files out of the function zip (.fnpushignore files are always honoured)")
+	gcpCmd.Flags().StringVar(&presetName, "preset", "", "A runtime preset (go, java, node, python or ruby) supplying default include/exclude globs")
+	gcpCmd.Flags().BoolVar(&overridePreset, "override-preset", false, "Replace the preset's excludes with the --exclude globs instead of adding to them")
 	gcpCmd.Flags().StringVarP(&versionSuffix, "versionSuffix", "v", "", "An optional string to append to layer and function keys to use as a version indicator")
+	gcpCmd.Flags().StringVar(&deployFunctionName, "deploy-function", "", "The name of a Cloud Function (2nd gen) to deploy from the uploaded source")
+	gcpCmd.Flags().StringVar(&project, "project", "", "The Google Cloud project the function lives in")
+	gcpCmd.Flags().StringVar(&functionRegion, "function-region", "", "The region the function is deployed to, eg europe-west2")
+	gcpCmd.Flags().StringVar(&functionRuntime, "runtime", "", "The Cloud Functions runtime to build with, eg nodejs20 (required when creating a function)")
+	gcpCmd.Flags().StringVar(&entryPoint, "entry-point", "", "The name of the exported function to invoke (required when creating a function)")
+	gcpCmd.Flags().DurationVar(&deployTimeout, "deploy-timeout", 15*time.Minute, "How long to wait for the function deployment to complete")
+	gcpCmd.Flags().StringVar(&sizeLimitAction, "size-limit", "warn", "What to do when the package is bigger than Cloud Functions allows, one of warn, fail or off")
+	gcpCmd.Flags().IntVar(&topContributors, "top", 10, "How many of the largest files and directories to list when the package is too big")
+	gcpCmd.Flags().StringVar(&artifact, "artifact", "", "The path to an already built zip file to upload instead of bundling the inputPath")
 
 	err := gcpCmd.MarkFlagRequired("buckets")
 	if err != nil {
@@ -0,0 +1,171 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bbeesley/fn-push/pkg/archive"
+	"github.com/spf13/cobra"
+)
+
+var s3Region string
+
+// Splits a bucket URL like s3://bucket/path/to/key.zip into its bucket and key
+func splitBucketURL(location string, scheme string) (bucket string, key string) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(location, scheme), "/")
+	if !ok || bucket == "" || key == "" {
+		log.Fatalf("Expected '%s' to look like %sbucket/key", location, scheme)
+	}
+	return bucket, key
+}
+
+// Loads an archive from a local path, an s3:// URL or a gs:// URL
+func loadArchive(location string) *bytes.Buffer {
+	switch {
+	case strings.HasPrefix(location, "s3://"):
+		bucket, key := splitBucketURL(location, "s3://")
+		return S3Download(s3Region, bucket, key)
+	case strings.HasPrefix(location, "gs://"):
+		bucket, key := splitBucketURL(location, "gs://")
+		return StorageDownload(bucket, key)
+	default:
+		return loadArtifact(location)
+	}
+}
+
+// Lists the entries of an archive, failing if it isn't a valid zip
+func mustReadEntries(location string, data *bytes.Buffer) []archive.Entry {
+	entries, err := archive.Entries(data.Bytes())
+	if err != nil {
+		log.Fatalf("Failed to read '%s': %v", location, err)
+	}
+	return entries
+}
+
+// Prints a value as indented JSON
+func printJSON(value any) {
+	output, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode JSON: %v", err)
+	}
+	fmt.Println(string(output))
+}
+
+// Describes what changed about an entry between two archives
+func describeChange(change archive.Change) string {
+	switch change.Kind {
+	case archive.Added:
+		return fmt.Sprintf("+ %s (%s)", change.Name, formatBytes(change.New.Size))
+	case archive.Removed:
+		return fmt.Sprintf("- %s (%s)", change.Name, formatBytes(change.Old.Size))
+	}
+	var details []string
+	if change.Old.Mode != change.New.Mode {
+		details = append(details, fmt.Sprintf("mode %s -> %s", change.Old.Mode, change.New.Mode))
+	}
+	if change.Old.LinkTarget != change.New.LinkTarget {
+		details = append(details, fmt.Sprintf("target %s -> %s", change.Old.LinkTarget, change.New.LinkTarget))
+	} else if change.Old.SHA256 != change.New.SHA256 {
+		details = append(details, fmt.Sprintf("size %s -> %s", formatBytes(change.Old.Size), formatBytes(change.New.Size)))
+		details = append(details, fmt.Sprintf("sha256 %.12s -> %.12s", change.Old.SHA256, change.New.SHA256))
+	}
+	return fmt.Sprintf("~ %s (%s)", change.Name, strings.Join(details, ", "))
+}
+
+// lsCmd represents the ls command
+var lsCmd = &cobra.Command{
+	Use:   "ls <archive>",
+	Short: "List the entries in an archive",
+	Long: `Lists the entries in a zip archive with their modes, sizes and
+	symlink targets. The archive can be a local path, an s3://bucket/key
+	URL or a gs://bucket/key URL.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		entries := mustReadEntries(args[0], loadArchive(args[0]))
+		if jsonOutput {
+			printJSON(entries)
+			return
+		}
+		for _, entry := range entries {
+			name := entry.Name
+			if entry.LinkTarget != "" {
+				name = fmt.Sprintf("%s -> %s", name, entry.LinkTarget)
+			}
+			fmt.Printf("%s %10s  %s\n", entry.Mode, formatBytes(entry.Size), name)
+		}
+	},
+}
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff <old> [new]",
+	Short: "Compare two archives",
+	Long: `Compares two zip archives, listing the entries which were added,
+	removed or changed along with their size and hash differences. Each
+	archive can be a local path, an s3://bucket/key URL or a gs://bucket/key
+	URL. When only one archive is given it's compared with a fresh bundle of
+	the inputPath, eg to see what a deploy would change. The bundle is the
+	function zip the aws command would upload with the same flags, so pass
+	the --layerKey, --layer and symlink flags your deploy uses.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		oldEntries := mustReadEntries(args[0], loadArchive(args[0]))
+		var newEntries []archive.Entry
+		if len(args) == 2 {
+			newEntries = mustReadEntries(args[1], loadArchive(args[1]))
+		} else {
+			applyPreset(cmd.Flags(), &lambdaRuntime)
+			newEntries = mustReadEntries(inputPath, localBundle(cmd.Flags(), progressWriter()))
+		}
+
+		changes := archive.Diff(oldEntries, newEntries)
+		if jsonOutput {
+			if changes == nil {
+				changes = []archive.Change{}
+			}
+			printJSON(changes)
+			return
+		}
+		counts := map[string]int{}
+		for _, change := range changes {
+			fmt.Println(describeChange(change))
+			counts[change.Kind]++
+		}
+		fmt.Printf("%d added, %d removed, %d changed\n", counts[archive.Added], counts[archive.Removed], counts[archive.Changed])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(lsCmd)
+	lsCmd.Flags().StringVar(&s3Region, "region", "", "The region of the S3 bucket, when listing an s3:// URL (defaults to the region from your AWS config)")
+	lsCmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the entries as JSON")
+
+	RootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringVar(&s3Region, "region", "", "The region of the S3 bucket, when comparing an s3:// URL (defaults to the region from your AWS config)")
+	diffCmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the changes as JSON")
+	addBundleFlags(diffCmd)
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"io"
+	"testing"
+
+	"github.com/bbeesley/fn-push/pkg/archive"
+)
+
+func TestSplitBucketURL(t *testing.T) {
+	bucket, key := splitBucketURL("s3://my-bucket/path/to/fn.zip", "s3://")
+	if bucket != "my-bucket" || key != "path/to/fn.zip" {
+		t.Fatalf("Unexpected bucket %s and key %s", bucket, key)
+	}
+}
+
+func TestDescribeChange(t *testing.T) {
+	cases := map[string]archive.Change{
+		"+ a.js (1.0 KiB)": {Name: "a.js", Kind: archive.Added, New: &archive.Entry{Size: 1024}},
+		"- b.js (10 B)":    {Name: "b.js", Kind: archive.Removed, Old: &archive.Entry{Size: 10}},
+		"~ c.js (size 10 B -> 12 B, sha256 aaaaaaaaaaaa -> bbbbbbbbbbbb)": {
+			Name: "c.js",
+			Kind: archive.Changed,
+			Old:  &archive.Entry{Size: 10, Mode: 0644, SHA256: "aaaaaaaaaaaaaaaa"},
+			New:  &archive.Entry{Size: 12, Mode: 0644, SHA256: "bbbbbbbbbbbbbbbb"},
+		},
+		"~ node_modules (target /opt/a -> /opt/b)": {
+			Name: "node_modules",
+			Kind: archive.Changed,
+			Old:  &archive.Entry{LinkTarget: "/opt/a", SHA256: "a"},
+			New:  &archive.Entry{LinkTarget: "/opt/b", SHA256: "b"},
+		},
+	}
+	for expected, change := range cases {
+		if actual := describeChange(change); actual != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, actual)
+		}
+	}
+}
+
+func TestDiffLocalBundle(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{"index.js", "lib/util.js"}))
+	setForTest(t, &include, []string{"**"})
+	setForTest(t, &exclude, []string{})
+	setForTest(t, &rootDir, "")
+	setForTest(t, &lambdaRuntime, "node")
+	setForTest(t, &layerKey, "")
+	first := mustReadEntries(inputPath, localBundle(diffCmd.Flags(), io.Discard))
+
+	setForTest(t, &exclude, []string{"lib/**"})
+	second := mustReadEntries(inputPath, localBundle(diffCmd.Flags(), io.Discard))
+
+	changes := archive.Diff(first, second)
+	if len(changes) != 1 || changes[0].Name != "lib/util.js" || changes[0].Kind != archive.Removed {
+		t.Fatalf("Unexpected changes: %v", changes)
+	}
+}
+
+func TestDiffLocalBundleWithLayer(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{"index.js", "node_modules/a/index.js"}))
+	setForTest(t, &include, []string{"**"})
+	setForTest(t, &exclude, []string{})
+	setForTest(t, &rootDir, "")
+	setForTest(t, &lambdaRuntime, "node")
+	setForTest(t, &nodeLayoutName, "npm")
+	setForTest(t, &layerKey, "layers/deps")
+	setForTest(t, &symlinkNodeModules, true)
+	setForTest(t, &symlinkName, "node_modules")
+	setForTest(t, &symlinkTarget, "")
+
+	entries := mustReadEntries(inputPath, localBundle(diffCmd.Flags(), io.Discard))
+	if len(entries) != 2 || entries[0].Name != "node_modules" || entries[0].LinkTarget == "" || entries[1].Name != "index.js" {
+		t.Fatalf("Expected the function zip aws would upload, got %v", entries)
+	}
+}
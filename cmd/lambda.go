@@ -0,0 +1,197 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+// Creates a lambda client for the given region using the default credential chain
+func newLambdaClient(region string) *lambda.Client {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		panic(err)
+	}
+
+	return lambda.NewFromConfig(cfg, func(o *lambda.Options) {
+		o.Region = region
+	})
+}
+
+// Points a lambda function at a newly uploaded object, waits for the update to complete, and optionally
+// publishes a version and moves an alias to it
+func LambdaUpdateFunctionCode(region string, functionName string, bucket string, keyName string, objectVersion string, publish bool, alias string, timeout time.Duration) {
+	ctx := context.TODO()
+	client := newLambdaClient(region)
+
+	input := &lambda.UpdateFunctionCodeInput{
+		FunctionName: aws.String(functionName),
+		S3Bucket:     aws.String(bucket),
+		S3Key:        aws.String(keyName),
+		Publish:      publish,
+	}
+	if objectVersion != "" {
+		input.S3ObjectVersion = aws.String(objectVersion)
+	}
+	output, err := client.UpdateFunctionCode(ctx, input)
+	if err != nil {
+		log.Fatalf("failed to update function code for '%s' in %s: %v", functionName, region, err)
+	}
+
+	waiter := lambda.NewFunctionUpdatedV2Waiter(client)
+	err = waiter.Wait(ctx, &lambda.GetFunctionInput{FunctionName: aws.String(functionName)}, timeout)
+	if err != nil {
+		log.Fatalf("function '%s' in %s did not finish updating: %v", functionName, region, err)
+	}
+	fmt.Printf("Successfully updated %s in %s to %s/%s\n", functionName, region, bucket, keyName)
+
+	if !publish {
+		return
+	}
+	version := aws.ToString(output.Version)
+	fmt.Printf("Published version %s of %s in %s\n", version, functionName, region)
+	if alias != "" {
+		lambdaMoveAlias(ctx, client, functionName, alias, version)
+		fmt.Printf("Moved alias %s of %s in %s to version %s\n", alias, functionName, region, version)
+	}
+}
+
+// Points an alias at the given function version, creating the alias if it doesn't exist yet
+func lambdaMoveAlias(ctx context.Context, client *lambda.Client, functionName string, alias string, version string) {
+	_, err := client.UpdateAlias(ctx, &lambda.UpdateAliasInput{
+		FunctionName:    aws.String(functionName),
+		Name:            aws.String(alias),
+		FunctionVersion: aws.String(version),
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		_, err = client.CreateAlias(ctx, &lambda.CreateAliasInput{
+			FunctionName:    aws.String(functionName),
+			Name:            aws.String(alias),
+			FunctionVersion: aws.String(version),
+		})
+	}
+	if err != nil {
+		log.Fatalf("failed to move alias '%s' of '%s' to version %s: %v", alias, functionName, version, err)
+	}
+}
+
+// Maps a runtime and its version onto the lambda runtime identifiers a layer is compatible with
+func layerRuntimes(runtime string, version string) []types.Runtime {
+	if version == "" {
+		return nil
+	}
+	if runtime == "python" {
+		return []types.Runtime{types.Runtime(fmt.Sprintf("python%s", version))}
+	}
+	return []types.Runtime{types.Runtime(fmt.Sprintf("nodejs%s.x", version))}
+}
+
+// Publishes a new version of a lambda layer from an uploaded object and returns the layer version arn
+func LambdaPublishLayerVersion(region string, layerName string, bucket string, keyName string, objectVersion string, runtimes []types.Runtime, architectures []string, license string) string {
+	client := newLambdaClient(region)
+
+	content := &types.LayerVersionContentInput{
+		S3Bucket: aws.String(bucket),
+		S3Key:    aws.String(keyName),
+	}
+	if objectVersion != "" {
+		content.S3ObjectVersion = aws.String(objectVersion)
+	}
+	input := &lambda.PublishLayerVersionInput{
+		LayerName:          aws.String(layerName),
+		Content:            content,
+		CompatibleRuntimes: runtimes,
+	}
+	for _, architecture := range architectures {
+		input.CompatibleArchitectures = append(input.CompatibleArchitectures, types.Architecture(architecture))
+	}
+	if license != "" {
+		input.LicenseInfo = aws.String(license)
+	}
+	output, err := client.PublishLayerVersion(context.TODO(), input)
+	if err != nil {
+		log.Fatalf("failed to publish layer '%s' in %s: %v", layerName, region, err)
+	}
+	layerVersionArn := aws.ToString(output.LayerVersionArn)
+	fmt.Printf("Published layer version %s in %s\n", layerVersionArn, region)
+	return layerVersionArn
+}
+
+// Replaces any version of the given layer in a function's layer list with the new layer version,
+// appending it if the function doesn't use the layer yet
+func LambdaUpdateFunctionLayers(region string, functionName string, layerVersionArn string, timeout time.Duration) {
+	ctx := context.TODO()
+	client := newLambdaClient(region)
+
+	current, err := client.GetFunctionConfiguration(ctx, &lambda.GetFunctionConfigurationInput{
+		FunctionName: aws.String(functionName),
+	})
+	if err != nil {
+		log.Fatalf("failed to get configuration for '%s' in %s: %v", functionName, region, err)
+	}
+	layerArns := replaceLayerVersion(current.Layers, layerVersionArn)
+
+	_, err = client.UpdateFunctionConfiguration(ctx, &lambda.UpdateFunctionConfigurationInput{
+		FunctionName: aws.String(functionName),
+		Layers:       layerArns,
+	})
+	if err != nil {
+		log.Fatalf("failed to update layers for '%s' in %s: %v", functionName, region, err)
+	}
+
+	waiter := lambda.NewFunctionUpdatedV2Waiter(client)
+	err = waiter.Wait(ctx, &lambda.GetFunctionInput{FunctionName: aws.String(functionName)}, timeout)
+	if err != nil {
+		log.Fatalf("function '%s' in %s did not finish updating: %v", functionName, region, err)
+	}
+	fmt.Printf("Successfully updated %s in %s to use layer %s\n", functionName, region, layerVersionArn)
+}
+
+// Swaps the layer version arn into a list of layers, matching existing entries on the unversioned layer arn
+func replaceLayerVersion(layers []types.Layer, layerVersionArn string) []string {
+	layerArn := layerVersionArn[:strings.LastIndex(layerVersionArn, ":")]
+	var layerArns []string
+	replaced := false
+	for _, layer := range layers {
+		arn := aws.ToString(layer.Arn)
+		if arn[:strings.LastIndex(arn, ":")] == layerArn {
+			arn = layerVersionArn
+			replaced = true
+		}
+		layerArns = append(layerArns, arn)
+	}
+	if !replaced {
+		layerArns = append(layerArns, layerVersionArn)
+	}
+	return layerArns
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+type lambdaStubRequest struct {
+	Method string
+	Path   string
+	Body   map[string]interface{}
+}
+
+// Starts a stub lambda API which records the requests it receives and points the aws sdk at it
+func newLambdaStub(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) *[]lambdaStubRequest {
+	var mu sync.Mutex
+	requests := []lambdaStubRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error("Error reading request body", err)
+		}
+		req := lambdaStubRequest{Method: r.Method, Path: r.URL.Path}
+		if len(body) > 0 {
+			err = json.Unmarshal(body, &req.Body)
+			if err != nil {
+				t.Error("Error parsing request body", err)
+			}
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+	t.Setenv("AWS_ENDPOINT_URL_LAMBDA", server.URL)
+	return &requests
+}
+
+func TestLambdaUpdateFunctionCode(t *testing.T) {
+	requests := newLambdaStub(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/code"):
+			_, _ = w.Write([]byte(`{"FunctionName":"my-fn","Version":"7","LastUpdateStatus":"InProgress"}`))
+		case r.Method == http.MethodGet:
+			_, _ = w.Write([]byte(`{"Configuration":{"FunctionName":"my-fn","State":"Active","LastUpdateStatus":"Successful"}}`))
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/aliases/"):
+			_, _ = w.Write([]byte(`{"Name":"live","FunctionVersion":"7"}`))
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	LambdaUpdateFunctionCode("eu-west-2", "my-fn", "my-bucket", "fn/handler.zip", "abc123", true, "live", time.Minute)
+
+	if len(*requests) != 3 {
+		t.Fatal("length", len(*requests))
+	}
+	update := (*requests)[0]
+	if update.Path != "/2015-03-31/functions/my-fn/code" {
+		t.Fatalf("Expected: /2015-03-31/functions/my-fn/code, actual: %s", update.Path)
+	}
+	if update.Body["S3Bucket"] != "my-bucket" || update.Body["S3Key"] != "fn/handler.zip" || update.Body["S3ObjectVersion"] != "abc123" || update.Body["Publish"] != true {
+		t.Fatalf("Unexpected update request: %v", update.Body)
+	}
+	moveAlias := (*requests)[2]
+	if moveAlias.Path != "/2015-03-31/functions/my-fn/aliases/live" || moveAlias.Body["FunctionVersion"] != "7" {
+		t.Fatalf("Unexpected alias request: %s %v", moveAlias.Path, moveAlias.Body)
+	}
+}
+
+func TestLambdaMoveAliasCreatesMissingAlias(t *testing.T) {
+	requests := newLambdaStub(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			w.Header().Set("X-Amzn-Errortype", "ResourceNotFoundException")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"Type":"User","Message":"Alias not found"}`))
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"Name":"live","FunctionVersion":"3"}`))
+		}
+	})
+
+	lambdaMoveAlias(context.TODO(), newLambdaClient("eu-west-2"), "my-fn", "live", "3")
+
+	if len(*requests) != 2 {
+		t.Fatal("length", len(*requests))
+	}
+	create := (*requests)[1]
+	if create.Path != "/2015-03-31/functions/my-fn/aliases" || create.Body["Name"] != "live" || create.Body["FunctionVersion"] != "3" {
+		t.Fatalf("Unexpected create alias request: %s %v", create.Path, create.Body)
+	}
+}
+
+func TestLambdaPublishLayerVersion(t *testing.T) {
+	requests := newLambdaStub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"LayerVersionArn":"arn:aws:lambda:eu-west-2:123456789012:layer:deps:4","Version":4}`))
+	})
+
+	arn := LambdaPublishLayerVersion("eu-west-2", "deps", "my-bucket", "fn/layer.zip", "", layerRuntimes("node", "20"), []string{"arm64"}, "MIT")
+
+	if arn != "arn:aws:lambda:eu-west-2:123456789012:layer:deps:4" {
+		t.Fatalf("Unexpected layer version arn: %s", arn)
+	}
+	publishRequest := (*requests)[0]
+	if publishRequest.Path != "/2018-10-31/layers/deps/versions" {
+		t.Fatalf("Expected: /2018-10-31/layers/deps/versions, actual: %s", publishRequest.Path)
+	}
+	runtimes := publishRequest.Body["CompatibleRuntimes"].([]interface{})
+	if len(runtimes) != 1 || runtimes[0] != "nodejs20.x" {
+		t.Fatalf("Unexpected runtimes: %v", runtimes)
+	}
+	architectures := publishRequest.Body["CompatibleArchitectures"].([]interface{})
+	if len(architectures) != 1 || architectures[0] != "arm64" {
+		t.Fatalf("Unexpected architectures: %v", architectures)
+	}
+	if publishRequest.Body["LicenseInfo"] != "MIT" {
+		t.Fatalf("Expected: MIT, actual: %v", publishRequest.Body["LicenseInfo"])
+	}
+}
+
+func TestLayerRuntimes(t *testing.T) {
+	if runtimes := layerRuntimes("node", "20"); len(runtimes) != 1 || runtimes[0] != "nodejs20.x" {
+		t.Fatalf("Unexpected runtimes: %v", runtimes)
+	}
+	if runtimes := layerRuntimes("python", "3.12"); len(runtimes) != 1 || runtimes[0] != "python3.12" {
+		t.Fatalf("Unexpected runtimes: %v", runtimes)
+	}
+	if runtimes := layerRuntimes("python", ""); len(runtimes) != 0 {
+		t.Fatalf("Unexpected runtimes: %v", runtimes)
+	}
+}
+
+func TestReplaceLayerVersion(t *testing.T) {
+	layers := []types.Layer{
+		{Arn: aws.String("arn:aws:lambda:eu-west-2:123456789012:layer:insights:21")},
+		{Arn: aws.String("arn:aws:lambda:eu-west-2:123456789012:layer:deps:3")},
+	}
+	actual := replaceLayerVersion(layers, "arn:aws:lambda:eu-west-2:123456789012:layer:deps:4")
+	if len(actual) != 2 || actual[0] != "arn:aws:lambda:eu-west-2:123456789012:layer:insights:21" || actual[1] != "arn:aws:lambda:eu-west-2:123456789012:layer:deps:4" {
+		t.Fatalf("Unexpected layers: %v", actual)
+	}
+	actual = replaceLayerVersion(layers[:1], "arn:aws:lambda:eu-west-2:123456789012:layer:deps:4")
+	if len(actual) != 2 || actual[1] != "arn:aws:lambda:eu-west-2:123456789012:layer:deps:4" {
+		t.Fatalf("Unexpected layers: %v", actual)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bbeesley/fn-push/pkg/archive"
+	"github.com/bbeesley/fn-push/pkg/zip"
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// An extra layer given with --layer, holding the files its globs match
+type layerSpec struct {
+	key     string
+	include []string
+}
+
+// A built layer zip and the key it's uploaded under, before any version suffix or hash is added
+type layerZip struct {
+	key  string
+	data *bytes.Buffer
+}
+
+// Parses --layer flags, each of which looks like key=glob[,glob...]
+func parseLayerSpecs(flags []string) ([]layerSpec, error) {
+	var specs []layerSpec
+	seen := map[string]bool{}
+	for _, flag := range flags {
+		key, globs, ok := strings.Cut(flag, "=")
+		if !ok || key == "" || globs == "" {
+			return nil, fmt.Errorf("invalid --layer '%s', expected key=glob[,glob...]", flag)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("the layer key '%s' is used more than once", key)
+		}
+		seen[key] = true
+		spec := layerSpec{key: key}
+		for _, glob := range strings.Split(globs, ",") {
+			if !doublestar.ValidatePattern(glob) {
+				return nil, fmt.Errorf("invalid glob '%s' in --layer '%s'", glob, flag)
+			}
+			spec.include = append(spec.include, glob)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func mustParseLayerSpecs() []layerSpec {
+	specs, err := parseLayerSpecs(layerFlags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, spec := range specs {
+		if spec.key == layerKey {
+			log.Fatalf("The --layer key '%s' is the same as the --layerKey", spec.key)
+		}
+	}
+	return specs
+}
+
+// Returns the include globs of all of the layers, which is everything they take out of the function
+func layerIncludes(specs []layerSpec) []string {
+	var globs []string
+	for _, spec := range specs {
+		globs = append(globs, spec.include...)
+	}
+	return globs
+}
+
+// Splits entries into those matching one of the globs and the rest
+func splitEntries(entries []zip.Entry, globs []string) (matched []zip.Entry, rest []zip.Entry) {
+	for _, entry := range entries {
+		if matchesAnyGlob(globs, entry.Name) {
+			matched = append(matched, entry)
+		} else {
+			rest = append(rest, entry)
+		}
+	}
+	return matched, rest
+}
+
+func matchesAnyGlob(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := doublestar.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds the extra layers. Each file goes into the first layer whose globs match it, and entries (from a pnpm or
+// plug'n'play install) are split between the layers the same way, returning the entries no layer took.
+func buildExtraLayers(specs []layerSpec, opts zip.Options, entries []zip.Entry) ([]layerZip, []zip.Entry) {
+	var layers []layerZip
+	flat := entries != nil
+	for ix, spec := range specs {
+		layerOpts := opts
+		layerOpts.Include = spec.include
+		layerOpts.Exclude = append(append([]string{}, opts.Exclude...), layerIncludes(specs[:ix])...)
+		if flat {
+			layerOpts.Include = []string{}
+			layerOpts.Entries, entries = splitEntries(entries, spec.include)
+		}
+		fmt.Fprintf(opts.LogWriter(), "Building layer %s\n", spec.key)
+		layers = append(layers, layerZip{key: spec.key, data: zip.CreateWithOptions(inputPath, layerOpts)})
+	}
+	if flat && entries == nil {
+		entries = []zip.Entry{}
+	}
+	return layers, entries
+}
+
+// Works out the bucket key for a layer zip, naming it after its contents with --content-addressed-layer
+func layerKeyName(layer layerZip) string {
+	if !contentAddressedLayer {
+		return keyName(layer.key, versionSuffix)
+	}
+	hash, err := archive.ContentHash(layer.data.Bytes())
+	if err != nil {
+		log.Fatalf("Failed to hash layer zip: %v", err)
+	}
+	name := contentKeyName(layer.key, hash)
+	fmt.Printf("Shared layer key: %s\n", name)
+	return name
+}
+
+// Uploads a layer zip, skipping content addressed layers which are already in the bucket, and returns the
+// version of the object
+func uploadLayer(region string, bucket string, name string, data *bytes.Buffer) string {
+	if contentAddressedLayer {
+		version, exists := S3Exists(region, bucket, name)
+		if exists {
+			fmt.Printf("%s is already in %s in %s, skipping upload\n", name, bucket, region)
+			return version
+		}
+	}
+	return S3Upload(region, bucket, name, data)
+}
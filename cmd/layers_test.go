@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"testing"
+
+	fnzip "github.com/bbeesley/fn-push/pkg/zip"
+)
+
+func TestParseLayerSpecs(t *testing.T) {
+	specs, err := parseLayerSpecs([]string{
+		"layers/sdk=node_modules/@aws-sdk/**,node_modules/sharp/**",
+		"layers/utils=node_modules/lodash/**",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 || specs[0].key != "layers/sdk" || len(specs[0].include) != 2 || specs[1].include[0] != "node_modules/lodash/**" {
+		t.Fatalf("Unexpected layer specs: %+v", specs)
+	}
+	for _, invalid := range [][]string{
+		{"layers/sdk"},
+		{"=node_modules/**"},
+		{"layers/sdk="},
+		{"layers/sdk=node_modules/[/**"},
+		{"layers/sdk=node_modules/a/**", "layers/sdk=node_modules/b/**"},
+	} {
+		if _, err := parseLayerSpecs(invalid); err == nil {
+			t.Fatalf("Expected an error parsing %v", invalid)
+		}
+	}
+}
+
+func TestBuildExtraLayers(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{
+		"index.js",
+		"node_modules/@aws-sdk/client-s3/index.js",
+		"node_modules/sharp/index.js",
+		"node_modules/lodash/index.js",
+	}))
+	specs := []layerSpec{
+		{key: "layers/sdk", include: []string{"node_modules/@aws-sdk/**", "node_modules/sharp/**"}},
+		{key: "layers/heavy", include: []string{"node_modules/sharp/**"}},
+	}
+	layers, entries := buildExtraLayers(specs, fnzip.Options{RootDir: "nodejs"}, nil)
+	if entries != nil {
+		t.Fatal("Expected no entries without a flattened node_modules", entries)
+	}
+	if len(layers) != 2 || layers[0].key != "layers/sdk" {
+		t.Fatalf("Unexpected layers: %v", layers)
+	}
+	sdk := zipEntryNames(t, layers[0].data)
+	if len(sdk) != 2 || sdk[0] != "nodejs/node_modules/@aws-sdk/client-s3/index.js" || sdk[1] != "nodejs/node_modules/sharp/index.js" {
+		t.Fatalf("Unexpected sdk layer files: %v", sdk)
+	}
+	if heavy := zipEntryNames(t, layers[1].data); len(heavy) != 0 {
+		t.Fatalf("Expected files to only go in the first matching layer, got %v", heavy)
+	}
+}
+
+func TestBuildExtraLayersFromEntries(t *testing.T) {
+	entries := []fnzip.Entry{
+		{Source: "layers.go", Name: "node_modules/sharp/index.js"},
+		{Source: "layers.go", Name: "node_modules/lodash/index.js"},
+	}
+	setForTest(t, &inputPath, ".")
+	layers, rest := buildExtraLayers([]layerSpec{{key: "layers/sharp", include: []string{"node_modules/sharp/**"}}}, fnzip.Options{}, entries)
+	if files := zipEntryNames(t, layers[0].data); len(files) != 1 || files[0] != "node_modules/sharp/index.js" {
+		t.Fatalf("Unexpected layer files: %v", files)
+	}
+	if len(rest) != 1 || rest[0].Name != "node_modules/lodash/index.js" {
+		t.Fatalf("Unexpected remaining entries: %v", rest)
+	}
+	if _, rest := buildExtraLayers([]layerSpec{{key: "layers/all", include: []string{"**"}}}, fnzip.Options{}, entries); rest == nil {
+		t.Fatal("Expected an empty rather than nil list once every entry is in a layer")
+	}
+}
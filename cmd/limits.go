@@ -0,0 +1,124 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/bbeesley/fn-push/pkg/archive"
+)
+
+const mib = 1024 * 1024
+
+// The largest deployment package a provider will accept
+type sizeLimits struct {
+	provider string
+	// The largest a single zip can be, or 0 when only the unzipped size is limited
+	zipped int64
+	// The largest the function and its layers can be once extracted
+	unzipped int64
+}
+
+// Code and layers are always uploaded to Lambda through S3, where the 50 MiB zip limit for direct uploads doesn't apply
+var lambdaLimits = sizeLimits{provider: "Lambda", unzipped: 250 * mib}
+
+var cloudFunctionLimits = sizeLimits{provider: "Cloud Functions", zipped: 100 * mib, unzipped: 500 * mib}
+
+// Lists the ways the function and layer zips, keyed by layer key, break the provider's limits
+func sizeProblems(limits sizeLimits, function archive.Summary, layers map[string]archive.Summary) []string {
+	var problems []string
+	if limits.zipped > 0 && function.Zipped > limits.zipped {
+		problems = append(problems, fmt.Sprintf("the function zip is %s, over the %s limit of %s", formatBytes(function.Zipped), limits.provider, formatBytes(limits.zipped)))
+	}
+	total := function
+	keys := make([]string, 0, len(layers))
+	for key := range layers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		layer := layers[key]
+		if limits.zipped > 0 && layer.Zipped > limits.zipped {
+			problems = append(problems, fmt.Sprintf("the layer zip %s is %s, over the %s limit of %s", key, formatBytes(layer.Zipped), limits.provider, formatBytes(limits.zipped)))
+		}
+		total = archive.Merge(total, layer)
+	}
+	if total.Unzipped > limits.unzipped {
+		problems = append(problems, fmt.Sprintf("the unzipped package is %s, over the %s limit of %s", formatBytes(total.Unzipped), limits.provider, formatBytes(limits.unzipped)))
+	}
+	return problems
+}
+
+// Checks the function zip, if there is one, and layer zips against the provider's size limits before anything is uploaded, warning or
+// failing depending on --size-limit and listing the biggest files and directories
+func checkSizeLimits(limits sizeLimits, functionData *bytes.Buffer, layers []layerZip) {
+	if sizeLimitAction == "off" {
+		return
+	}
+	if sizeLimitAction != "warn" && sizeLimitAction != "fail" {
+		log.Fatalf("Unknown --size-limit '%s', expected one of warn, fail or off", sizeLimitAction)
+	}
+	var function archive.Summary
+	if functionData != nil {
+		var err error
+		function, err = archive.Read(functionData.Bytes())
+		if err != nil {
+			log.Fatalf("Failed to read function zip: %v", err)
+		}
+		fmt.Printf("Function zip is %s (%s unzipped)\n", formatBytes(function.Zipped), formatBytes(function.Unzipped))
+	}
+	total := function
+	summaries := map[string]archive.Summary{}
+	for _, layer := range layers {
+		layerSummary, err := archive.Read(layer.data.Bytes())
+		if err != nil {
+			log.Fatalf("Failed to read layer zip: %v", err)
+		}
+		fmt.Printf("Layer zip %s is %s (%s unzipped)\n", layer.key, formatBytes(layerSummary.Zipped), formatBytes(layerSummary.Unzipped))
+		summaries[layer.key] = layerSummary
+		total = archive.Merge(total, layerSummary)
+	}
+
+	problems := sizeProblems(limits, function, summaries)
+	if len(problems) == 0 {
+		return
+	}
+	for _, problem := range problems {
+		fmt.Printf("Size limit exceeded: %s\n", problem)
+	}
+	if topContributors > 0 {
+		fmt.Printf("Largest directories:\n")
+		for _, dir := range total.LargestDirs(topContributors) {
+			fmt.Printf("  %10s  %s\n", formatBytes(dir.Size), dir.Name)
+		}
+		fmt.Printf("Largest files:\n")
+		for _, file := range total.LargestFiles(topContributors) {
+			fmt.Printf("  %10s  %s\n", formatBytes(file.Size), file.Name)
+		}
+	}
+	if sizeLimitAction == "fail" {
+		log.Fatalf("The package is too big for %s", limits.provider)
+	}
+}
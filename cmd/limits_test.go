@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bbeesley/fn-push/pkg/archive"
+)
+
+func TestSizeProblems(t *testing.T) {
+	limits := sizeLimits{provider: "Lambda", zipped: 100, unzipped: 1000}
+
+	function := archive.Summary{Zipped: 50, Unzipped: 600}
+	if problems := sizeProblems(limits, function, nil); len(problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", problems)
+	}
+
+	layer := archive.Summary{Zipped: 150, Unzipped: 500}
+	problems := sizeProblems(limits, function, map[string]archive.Summary{"layers/deps": layer})
+	if len(problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", problems)
+	}
+	if !strings.Contains(problems[0], "layer zip layers/deps") || !strings.Contains(problems[1], "unzipped package is 1.1 KiB") {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+
+	function.Zipped = 200
+	if problems := sizeProblems(limits, function, nil); len(problems) != 1 || !strings.Contains(problems[0], "function zip") {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+
+	limits.zipped = 0
+	if problems := sizeProblems(limits, function, map[string]archive.Summary{"layers/deps": layer}); len(problems) != 1 || !strings.Contains(problems[0], "unzipped package") {
+		t.Fatalf("Expected only the unzipped limit without a zipped limit, got %v", problems)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/bbeesley/fn-push/pkg/archive"
+	"github.com/bbeesley/fn-push/pkg/zip"
+	"github.com/spf13/viper"
+)
+
+// Parses symlinks given as name=target, from --extra-symlink flags or the symlinks list in the config file
+func parseLinks(specs []string) ([]zip.Link, error) {
+	var links []zip.Link
+	for _, spec := range specs {
+		name, target, ok := strings.Cut(spec, "=")
+		if !ok || target == "" {
+			return nil, fmt.Errorf("invalid symlink '%s', expected name=target", spec)
+		}
+		links = append(links, zip.Link{Name: name, Target: target})
+	}
+	return links, nil
+}
+
+// Checks the links can be extracted: names have to be relative paths inside the zip, and relative targets can't
+// point outside of it
+func checkLinkNames(links []zip.Link) error {
+	seen := map[string]bool{}
+	for _, link := range links {
+		if link.Name == "" || path.IsAbs(link.Name) || path.Clean(link.Name) != link.Name || strings.HasPrefix(link.Name, "../") || link.Name == ".." {
+			return fmt.Errorf("invalid symlink name '%s', expected a relative path like node_modules", link.Name)
+		}
+		if seen[link.Name] {
+			return fmt.Errorf("there's more than one symlink called '%s'", link.Name)
+		}
+		seen[link.Name] = true
+		if !path.IsAbs(link.Target) {
+			resolved := path.Join(path.Dir(link.Name), link.Target)
+			if resolved == ".." || strings.HasPrefix(resolved, "../") {
+				return fmt.Errorf("the symlink '%s' points at '%s', which is outside of the zip", link.Name, link.Target)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the symlinks to add to the function zip: the link to the layer's node_modules with
+// --symlinkNodeModules, which points at the layer's root dir in /opt (eg /opt/nodejs) unless --symlink-target says
+// otherwise, and any extra symlinks
+func functionLinks(layerRootDir string) []zip.Link {
+	var links []zip.Link
+	if symlinkNodeModules {
+		target := symlinkTarget
+		if target == "" {
+			target = path.Join("/opt", layerRootDir)
+		}
+		// the layer built with --layerKey is extracted to its root dir in /opt, so the link has to point inside it
+		if root := path.Join("/opt", layerRootDir); layerKey != "" && !within(path.Clean(target), root) {
+			log.Fatalf("The %s symlink points at '%s', but the layer is extracted to %s", symlinkName, target, root)
+		}
+		links = append(links, zip.Link{Name: symlinkName, Target: target})
+	}
+	extra, err := parseLinks(append(viper.GetStringSlice("symlinks"), extraSymlinks...))
+	if err != nil {
+		log.Fatal(err)
+	}
+	links = append(links, extra...)
+	if err := checkLinkNames(links); err != nil {
+		log.Fatal(err)
+	}
+	return links
+}
+
+// Checks that links into the layer's part of /opt point at something the layers built alongside the function
+// actually contain
+func checkLinkTargets(links []zip.Link, layerRootDir string, layers []layerZip) error {
+	if len(layers) == 0 || layerRootDir == "" {
+		return nil
+	}
+	top := path.Join("/opt", strings.Split(layerRootDir, "/")[0])
+	var contents []archive.Summary
+	for _, layer := range layers {
+		summary, err := archive.Read(layer.data.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to read layer zip: %w", err)
+		}
+		contents = append(contents, summary)
+	}
+	for _, link := range links {
+		target := path.Clean(link.Target)
+		if !within(target, top) {
+			continue
+		}
+		if !layersContain(contents, strings.TrimPrefix(target, "/opt/")) {
+			return fmt.Errorf("the %s symlink points at '%s', but there's nothing there in the layers", link.Name, link.Target)
+		}
+	}
+	return nil
+}
+
+// Reports whether target is dir or somewhere inside it
+func within(target string, dir string) bool {
+	return target == dir || strings.HasPrefix(target, dir+"/")
+}
+
+// Reports whether any of the layers has a file or directory at name
+func layersContain(layers []archive.Summary, name string) bool {
+	for _, layer := range layers {
+		for _, f := range layer.Files {
+			if within(f.Name, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"testing"
+
+	fnzip "github.com/bbeesley/fn-push/pkg/zip"
+)
+
+func TestParseLinks(t *testing.T) {
+	links, err := parseLinks([]string{"bin=/opt/bin", "lib/node_modules=../node_modules"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 || links[0] != (fnzip.Link{Name: "bin", Target: "/opt/bin"}) || links[1].Target != "../node_modules" {
+		t.Fatalf("Unexpected links: %v", links)
+	}
+	for _, invalid := range []string{"bin", "bin="} {
+		if _, err := parseLinks([]string{invalid}); err == nil {
+			t.Fatal("Expected an error parsing", invalid)
+		}
+	}
+}
+
+func TestCheckLinkNames(t *testing.T) {
+	valid := []fnzip.Link{{Name: "node_modules", Target: "/opt/nodejs/node_modules"}, {Name: "lib/deps", Target: "../node_modules"}}
+	if err := checkLinkNames(valid); err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range [][]fnzip.Link{
+		{{Name: "/node_modules", Target: "/opt"}},
+		{{Name: "../node_modules", Target: "/opt"}},
+		{{Name: "lib//deps", Target: "/opt"}},
+		{{Name: "deps", Target: "../outside"}},
+		{{Name: "deps", Target: "/opt/a"}, {Name: "deps", Target: "/opt/b"}},
+	} {
+		if err := checkLinkNames(invalid); err == nil {
+			t.Fatal("Expected an error for", invalid)
+		}
+	}
+}
+
+func TestFunctionLinks(t *testing.T) {
+	setForTest(t, &symlinkNodeModules, true)
+	setForTest(t, &symlinkName, "node_modules")
+	setForTest(t, &symlinkTarget, "")
+	setForTest(t, &extraSymlinks, []string{})
+	setForTest(t, &layerKey, "layers/deps")
+	if links := functionLinks("nodejs/node20"); len(links) != 1 || links[0].Target != "/opt/nodejs/node20" {
+		t.Fatalf("Unexpected links: %v", links)
+	}
+	setForTest(t, &symlinkTarget, "/opt/nodejs/node20/node_modules/")
+	setForTest(t, &extraSymlinks, []string{"bin=/opt/nodejs/node20/node_modules/.bin"})
+	links := functionLinks("nodejs/node20")
+	if len(links) != 2 || links[0].Target != "/opt/nodejs/node20/node_modules/" || links[1].Name != "bin" {
+		t.Fatalf("Unexpected links: %v", links)
+	}
+}
+
+func TestCheckLinkTargets(t *testing.T) {
+	setForTest(t, &inputPath, writeTestTree(t, []string{"node_modules/a/index.js"}))
+	layers := []layerZip{{key: "layers/deps", data: fnzip.CreateWithOptions(inputPath, fnzip.Options{
+		Include: []string{"node_modules/**"},
+		RootDir: "nodejs/node20",
+	})}}
+	valid := []fnzip.Link{
+		{Name: "node_modules", Target: "/opt/nodejs/node20/node_modules"},
+		{Name: "a", Target: "/opt/nodejs/node20/node_modules/a/index.js"},
+		{Name: "ext", Target: "/opt/extensions/ext"},
+		{Name: "local", Target: "lib"},
+	}
+	if err := checkLinkTargets(valid, "nodejs/node20", layers); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLinkTargets(valid, "nodejs/node20", nil); err != nil {
+		t.Fatal("Expected no checks without any layers", err)
+	}
+	for _, target := range []string{"/opt/nodejs/node_modules", "/opt/nodejs/node20/node_modules/b", "/opt/nodejs/node20/node_mod"} {
+		if err := checkLinkTargets([]fnzip.Link{{Name: "node_modules", Target: target}}, "nodejs/node20", layers); err == nil {
+			t.Fatal("Expected an error for a link to", target)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/bbeesley/fn-push/pkg/preset"
+	"github.com/spf13/cobra"
+)
+
+// ResolvedPreset describes the packaging rules a preset produces once combined with any user supplied globs
+type ResolvedPreset struct {
+	Name    string         `json:"name"`
+	Include []string       `json:"include"`
+	Exclude []string       `json:"exclude"`
+	Layer   *ResolvedLayer `json:"layer,omitempty"`
+}
+
+// ResolvedLayer describes where a preset's layer dependencies come from and where they go in the layer zip
+type ResolvedLayer struct {
+	Source  string   `json:"source"`
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+	RootDir string   `json:"rootDir"`
+}
+
+// presetCmd represents the preset command
+var presetCmd = &cobra.Command{
+	Use:   "preset [name]",
+	Short: "Print the packaging rules a runtime preset resolves to",
+	Long: `Prints the include and exclude globs and the layer layout
+	that a runtime preset supplies, combined with any --include and
+	--exclude globs, so you can see exactly what will be bundled.`,
+	ValidArgs: preset.Names(),
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	Run: func(cmd *cobra.Command, args []string) {
+		p := mustGetPreset(args[0])
+		var userInclude []string
+		if cmd.Flags().Changed("include") {
+			userInclude = include
+		}
+		resolved := ResolvedPreset{Name: p.Name}
+		resolved.Include, resolved.Exclude = p.Resolve(userInclude, exclude, overridePreset)
+		if p.Layer != nil {
+			resolved.Layer = &ResolvedLayer{
+				Source:  filepath.Clean(p.Layer.Source),
+				Include: p.Layer.Include,
+				Exclude: p.Layer.Exclude,
+				RootDir: p.Layer.RootDir(presetVersion),
+			}
+		}
+
+		if jsonOutput {
+			output, err := json.MarshalIndent(resolved, "", "  ")
+			if err != nil {
+				log.Fatalf("Failed to encode preset: %v", err)
+			}
+			fmt.Println(string(output))
+			return
+		}
+		fmt.Printf("Preset: %s\n", resolved.Name)
+		fmt.Printf("Include:\n  %s\n", strings.Join(resolved.Include, "\n  "))
+		fmt.Printf("Exclude:\n  %s\n", strings.Join(resolved.Exclude, "\n  "))
+		if resolved.Layer != nil {
+			fmt.Println("Layer:")
+			fmt.Printf("  Source: %s\n", resolved.Layer.Source)
+			fmt.Printf("  Include: %s\n", strings.Join(resolved.Layer.Include, ", "))
+			fmt.Printf("  Exclude: %s\n", strings.Join(resolved.Layer.Exclude, ", "))
+			fmt.Printf("  Root: %s\n", resolved.Layer.RootDir)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(presetCmd)
+
+	presetCmd.Flags().StringArrayVarP(&include, "include", "i", []string{"**"}, "An array of globs to bundle instead of the preset's includes")
+	presetCmd.Flags().StringArrayVarP(&exclude, "exclude", "e", []string{}, "An array of globs to add to the preset's excludes")
+	presetCmd.Flags().BoolVar(&overridePreset, "override-preset", false, "Replace the preset's excludes with the --exclude globs instead of adding to them")
+	presetCmd.Flags().StringVar(&presetVersion, "runtime-version", "", "The runtime version to resolve the layer root for, eg 20 for node or 3.12 for python")
+	presetCmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the resolved rules as JSON")
+}
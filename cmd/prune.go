@@ -0,0 +1,236 @@
+/*
+Copyright © 2023 Bill Beesley <bill@beesley.dev>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bbeesley/fn-push/pkg/retention"
+	"github.com/spf13/cobra"
+)
+
+// PruneResult describes what a prune did (or would do) to a single bucket
+type PruneResult struct {
+	Provider string             `json:"provider"`
+	Region   string             `json:"region,omitempty"`
+	Bucket   string             `json:"bucket"`
+	Key      string             `json:"key"`
+	DryRun   bool               `json:"dryRun"`
+	Kept     []retention.Object `json:"kept"`
+	Deleted  []retention.Object `json:"deleted"`
+	// Skipped lists the keys under the base key which weren't considered, eg content addressed layers
+	Skipped []string `json:"skipped"`
+}
+
+// Reports whether a key was produced by fn-push for the given base key, with or without a version suffix. The
+// version can be anything, eg 1.2.3-rc.1, so keys which belong to one of the other base keys, like api-deps-1.2.3.zip
+// when pruning api alongside api-deps, are left out explicitly. Content addressed layers, which other functions may
+// share, never match, since contentKeyName doesn't put a dash after the base key.
+func isArtifactKey(key string, baseKey string, otherKeys []string) bool {
+	for _, other := range otherKeys {
+		if other != baseKey && strings.HasPrefix(other, baseKey) && isArtifactKey(key, other, nil) {
+			return false
+		}
+	}
+	if key == fmt.Sprintf("%s.zip", baseKey) {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(key, baseKey+"-")
+	if !ok {
+		return false
+	}
+	suffix, ok = strings.CutSuffix(suffix, ".zip")
+	return ok && suffix != ""
+}
+
+// Reads a list of deployed versions from a file, one per line, ignoring blank lines
+func readVersionsFile(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open versions file '%s': %v", path, err)
+	}
+	defer file.Close()
+
+	var versions []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		version := strings.TrimSpace(scanner.Text())
+		if version != "" {
+			versions = append(versions, version)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Failed to read versions file '%s': %v", path, err)
+	}
+	return versions
+}
+
+// Applies the retention policy to the objects stored under a base key, deleting anything it doesn't keep
+// unless this is a dry run
+func prune(region string, bucket string, baseKey string, otherKeys []string, policy retention.Policy) PruneResult {
+	var listed []retention.Object
+	if pruneProvider == "gcp" {
+		listed = StorageList(bucket, baseKey)
+	} else {
+		listed = S3List(region, bucket, baseKey)
+	}
+	var objects []retention.Object
+	skipped := []string{}
+	for _, object := range listed {
+		if isArtifactKey(object.Key, baseKey, otherKeys) {
+			objects = append(objects, object)
+		} else {
+			skipped = append(skipped, object.Key)
+		}
+	}
+
+	keep, remove := retention.Apply(objects, policy)
+	result := PruneResult{
+		Provider: pruneProvider,
+		Region:   region,
+		Bucket:   bucket,
+		Key:      baseKey,
+		DryRun:   dryRun,
+		Kept:     keep,
+		Deleted:  remove,
+		Skipped:  skipped,
+	}
+	if dryRun || len(remove) == 0 {
+		return result
+	}
+	var keyNames []string
+	for _, object := range remove {
+		keyNames = append(keyNames, object.Key)
+	}
+	if pruneProvider == "gcp" {
+		StorageDelete(bucket, keyNames)
+	} else {
+		S3Delete(region, bucket, keyNames)
+	}
+	return result
+}
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete old function assets from buckets",
+	Long: `Lists the versioned assets stored under a function key (and
+	optionally a layer key) in each bucket, keeps the newest, the most
+	recent, or the deployed ones, and deletes the rest. Runs as a dry
+	run unless --dry-run=false is passed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if pruneProvider != "aws" && pruneProvider != "gcp" {
+			log.Fatalf("Unknown provider '%s', expected aws or gcp", pruneProvider)
+		}
+		if pruneProvider == "aws" && len(regions) != len(buckets) {
+			log.Fatal("The --regions and --buckets flags must have the same number of entries")
+		}
+
+		versions := keepVersions
+		if keepVersionsFile != "" {
+			versions = append(versions, readVersionsFile(keepVersionsFile)...)
+		}
+		baseKeys := []string{functionKey}
+		if layerKey != "" {
+			baseKeys = append(baseKeys, layerKey)
+		}
+		otherKeys := append(append([]string{}, baseKeys...), pruneOtherKeys...)
+		policy := retention.Policy{
+			KeepLatest: keepLatest,
+			KeepWithin: keepWithin,
+			Now:        time.Now(),
+		}
+		for _, baseKey := range baseKeys {
+			for _, version := range versions {
+				policy.KeepKeys = append(policy.KeepKeys, keyName(baseKey, version))
+			}
+		}
+		if policy.IsEmpty() {
+			log.Fatal("Refusing to prune without a retention rule, set --keep, --keep-within or --keep-versions")
+		}
+
+		var results []PruneResult
+		for ix, bucket := range buckets {
+			region := ""
+			if pruneProvider == "aws" {
+				region = regions[ix]
+			}
+			for _, baseKey := range baseKeys {
+				results = append(results, prune(region, bucket, baseKey, otherKeys, policy))
+			}
+		}
+
+		if jsonOutput {
+			report, err := json.MarshalIndent(results, "", "  ")
+			if err != nil {
+				log.Fatalf("Failed to encode report: %v", err)
+			}
+			fmt.Println(string(report))
+			return
+		}
+		for _, result := range results {
+			for _, key := range result.Skipped {
+				fmt.Printf("Skipped %s in %s, which isn't a version of %s\n", key, result.Bucket, result.Key)
+			}
+			for _, object := range result.Deleted {
+				if result.DryRun {
+					fmt.Printf("Would delete %s from %s\n", object.Key, result.Bucket)
+				} else {
+					fmt.Printf("Deleted %s from %s\n", object.Key, result.Bucket)
+				}
+			}
+			fmt.Printf("Kept %d and removed %d objects under %s in %s\n", len(result.Kept), len(result.Deleted), result.Key, result.Bucket)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(pruneCmd)
+
+	pruneCmd.Flags().StringVar(&pruneProvider, "provider", "aws", "Which cloud the buckets are in, aws or gcp")
+	pruneCmd.Flags().StringArrayVarP(&regions, "regions", "r", []string{}, "A list of regions the buckets are in (aws only)")
+	pruneCmd.Flags().StringArrayVarP(&buckets, "buckets", "b", []string{}, "A list of buckets to prune (same order as the regions please")
+	pruneCmd.Flags().StringVarP(&functionKey, "functionKey", "f", "", "The path/filename of the function zip in the bucket, without the version suffix or .zip extension")
+	pruneCmd.Flags().StringVarP(&layerKey, "layerKey", "l", "", "The path/filename of the layer zip in the bucket, without the version suffix or .zip extension")
+	pruneCmd.Flags().StringArrayVar(&pruneOtherKeys, "other-key", []string{}, "Another function or layer key in the bucket starting with the functionKey or layerKey, eg api-deps when pruning api, whose objects must be left alone")
+	pruneCmd.Flags().IntVar(&keepLatest, "keep", 0, "Keep the newest N objects")
+	pruneCmd.Flags().DurationVar(&keepWithin, "keep-within", 0, "Keep objects modified within this duration, eg 720h")
+	pruneCmd.Flags().StringArrayVar(&keepVersions, "keep-versions", []string{}, "Version suffixes which are deployed and must be kept")
+	pruneCmd.Flags().StringVar(&keepVersionsFile, "keep-versions-file", "", "A file listing deployed version suffixes to keep, one per line")
+	pruneCmd.Flags().BoolVar(&dryRun, "dry-run", true, "Report what would be deleted without deleting anything")
+	pruneCmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+
+	err := pruneCmd.MarkFlagRequired("buckets")
+	if err != nil {
+		log.Fatal("Failed to set buckets flag as required", err)
+	}
+	err = pruneCmd.MarkFlagRequired("functionKey")
+	if err != nil {
+		log.Fatal("Failed to set functionKey flag as required", err)
+	}
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsArtifactKey(t *testing.T) {
+	cases := map[string]bool{
+		"fn/handler.zip":                  true,
+		"fn/handler-1.2.3.zip":            true,
+		"fn/handler-1.2.3-rc.1.zip":       true,
+		"fn/handler-2024-01-01.zip":       true,
+		"fn/handler-v1.2-3-gabc.zip":      true,
+		"fn/handler-0123456789abcdef.zip": true,
+		"fn/handler-1.2.3.tar":            false,
+		"fn/handler2-1.2.3.zip":           false,
+		"fn/handler/1.2.3.zip":            false,
+		"other/handler-1.2.3.zip":         false,
+		"fn/handler-.zip":                 false,
+	}
+	for key, expected := range cases {
+		if actual := isArtifactKey(key, "fn/handler", nil); actual != expected {
+			t.Fatalf("%s: expected %v, actual %v", key, expected, actual)
+		}
+	}
+
+	others := []string{"api", "api-deps"}
+	shared := map[string]bool{
+		"api-1.2.3.zip":      true,
+		"api-1.2.3-rc.1.zip": true,
+		"api-deps.zip":       false,
+		"api-deps-1.2.3.zip": false,
+		contentKeyName("api", "0123456789abcdef0123"): false,
+	}
+	for key, expected := range shared {
+		if actual := isArtifactKey(key, "api", others); actual != expected {
+			t.Fatalf("%s: expected %v, actual %v", key, expected, actual)
+		}
+	}
+	if !isArtifactKey("api-deps-1.2.3-rc.1.zip", "api-deps", others) {
+		t.Fatal("Expected a dashed version of api-deps to be pruned with it")
+	}
+	if isArtifactKey(contentKeyName("api-deps", "0123456789abcdef0123"), "api-deps", others) {
+		t.Fatal("Expected content addressed layers, which other functions may share, to never be pruned")
+	}
+}
+
+func TestReadVersionsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "versions.txt")
+	err := os.WriteFile(path, []byte("1.2.3\n\n  1.2.4 \n"), 0644)
+	if err != nil {
+		t.Fatal("Error writing versions file", err)
+	}
+	versions := readVersionsFile(path)
+	if len(versions) != 2 || versions[0] != "1.2.3" || versions[1] != "1.2.4" {
+		t.Fatalf("Unexpected versions: %v", versions)
+	}
+}
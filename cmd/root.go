@@ -24,6 +24,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -41,6 +42,56 @@ var layerKey string
 var nodeVersion string
 var versionSuffix string
 var symlinkNodeModules bool
+var artifact string
+var updateFunction string
+var publish bool
+var alias string
+var updateTimeout time.Duration
+var publishLayer string
+var layerArchitectures []string
+var layerLicense string
+var updateFunctionLayers bool
+var deployFunctionName string
+var project string
+var functionRegion string
+var functionRuntime string
+var entryPoint string
+var deployTimeout time.Duration
+var pruneProvider string
+var keepLatest int
+var keepWithin time.Duration
+var keepVersions []string
+var keepVersionsFile string
+var pruneOtherKeys []string
+var dryRun bool
+var jsonOutput bool
+var lambdaRuntime string
+var pythonVersion string
+var sitePackages string
+var binary string
+var presetName string
+var overridePreset bool
+var presetVersion string
+var useGitignore bool
+var prodOnly bool
+var cleanLayer bool
+var cleanSkip []string
+var cleanPatterns []string
+var sizeLimitAction string
+var topContributors int
+var compressionLevel int
+var compressor string
+var storePatterns []string
+var useCache bool
+var contentAddressedLayer bool
+var symlinkPolicy string
+var allowExternalSymlinks bool
+var nodeLayoutName string
+var layerFlags []string
+var symlinkName string
+var symlinkTarget string
+var extraSymlinks []string
+var extensionName string
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
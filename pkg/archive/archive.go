@@ -0,0 +1,314 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// File describes a file stored in a zip archive
+type File struct {
+	Name           string `json:"name"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressedSize"`
+}
+
+// Summary describes the size of a zip archive and the files in it
+type Summary struct {
+	// Zipped is the size of the archive itself
+	Zipped int64 `json:"zipped"`
+	// Unzipped is the total size of the files once extracted
+	Unzipped int64  `json:"unzipped"`
+	Files    []File `json:"files"`
+}
+
+// Read summarises the zip archive in data
+func Read(data []byte) (Summary, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return Summary{}, err
+	}
+	summary := Summary{Zipped: int64(len(data))}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		file := File{
+			Name:           f.Name,
+			Size:           int64(f.UncompressedSize64),
+			CompressedSize: int64(f.CompressedSize64),
+		}
+		summary.Unzipped += file.Size
+		summary.Files = append(summary.Files, file)
+	}
+	return summary, nil
+}
+
+// Merge combines summaries, eg of a function and its layers, into one
+func Merge(summaries ...Summary) Summary {
+	var merged Summary
+	for _, s := range summaries {
+		merged.Zipped += s.Zipped
+		merged.Unzipped += s.Unzipped
+		merged.Files = append(merged.Files, s.Files...)
+	}
+	return merged
+}
+
+// LargestFiles returns the n files with the largest unzipped size, biggest first
+func (s Summary) LargestFiles(n int) []File {
+	return largest(s.Files, n)
+}
+
+// LargestDirs returns the n directories whose files have the largest total unzipped size, biggest first. A
+// directory's total includes everything in its subdirectories. The root isn't listed, since it holds everything.
+func (s Summary) LargestDirs(n int) []File {
+	var dirs []File
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		for _, child := range node.Children {
+			if child.Children == nil {
+				continue
+			}
+			dirs = append(dirs, File{Name: child.Path, Size: child.Size, CompressedSize: child.CompressedSize})
+			walk(child)
+		}
+	}
+	walk(s.Tree())
+	return largest(dirs, n)
+}
+
+func largest(files []File, n int) []File {
+	sorted := make([]File, len(files))
+	copy(sorted, files)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Size > sorted[j].Size
+	})
+	if n >= 0 && n < len(sorted) {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// Node is a directory or file in an archive, with the total size of everything under it
+type Node struct {
+	Name           string  `json:"name"`
+	Path           string  `json:"path"`
+	Size           int64   `json:"size"`
+	CompressedSize int64   `json:"compressedSize"`
+	Files          int     `json:"files"`
+	Children       []*Node `json:"children,omitempty"`
+}
+
+// Tree arranges the files in the archive into a tree of directories. Children are sorted largest first.
+func (s Summary) Tree() *Node {
+	root := &Node{Name: "/", Path: ""}
+	dirs := map[string]*Node{"": root}
+	for _, f := range s.Files {
+		parent := root
+		parts := strings.Split(f.Name, "/")
+		for ix, part := range parts {
+			parent.Size += f.Size
+			parent.CompressedSize += f.CompressedSize
+			parent.Files++
+			nodePath := strings.Join(parts[:ix+1], "/")
+			if ix == len(parts)-1 {
+				parent.Children = append(parent.Children, &Node{Name: part, Path: nodePath, Size: f.Size, CompressedSize: f.CompressedSize, Files: 1})
+				break
+			}
+			dir, ok := dirs[nodePath]
+			if !ok {
+				dir = &Node{Name: part + "/", Path: nodePath + "/"}
+				dirs[nodePath] = dir
+				parent.Children = append(parent.Children, dir)
+			}
+			parent = dir
+		}
+	}
+	sortTree(root)
+	return root
+}
+
+func sortTree(node *Node) {
+	sort.SliceStable(node.Children, func(i, j int) bool {
+		return node.Children[i].Size > node.Children[j].Size
+	})
+	for _, child := range node.Children {
+		sortTree(child)
+	}
+}
+
+// Package is an npm package installed in an archive's node_modules
+type Package struct {
+	Name string `json:"name"`
+	// Path is where the package is installed, which tells nested copies of the same package apart
+	Path           string `json:"path"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressedSize"`
+	Files          int    `json:"files"`
+}
+
+// Packages totals the size of each npm package in the archive, largest first. Files in a package's own nested
+// node_modules count towards the nested package rather than the outer one.
+func (s Summary) Packages() []Package {
+	packages := map[string]*Package{}
+	var order []string
+	for _, f := range s.Files {
+		name, pkgPath, ok := packageOf(f.Name)
+		if !ok {
+			continue
+		}
+		if _, seen := packages[pkgPath]; !seen {
+			packages[pkgPath] = &Package{Name: name, Path: pkgPath}
+			order = append(order, pkgPath)
+		}
+		packages[pkgPath].Size += f.Size
+		packages[pkgPath].CompressedSize += f.CompressedSize
+		packages[pkgPath].Files++
+	}
+	result := make([]Package, 0, len(order))
+	for _, pkgPath := range order {
+		result = append(result, *packages[pkgPath])
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Size > result[j].Size
+	})
+	return result
+}
+
+// Works out which npm package a file belongs to, from the innermost node_modules directory in its path
+func packageOf(file string) (name string, pkgPath string, ok bool) {
+	const marker = "node_modules/"
+	ix := strings.LastIndex(file, marker)
+	if ix != 0 && (ix < 0 || file[ix-1] != '/') {
+		return "", "", false
+	}
+	parts := strings.Split(file[ix+len(marker):], "/")
+	size := 1
+	if strings.HasPrefix(parts[0], "@") {
+		size = 2
+	}
+	// files directly in node_modules, or a scope directory, aren't part of a package
+	if len(parts) <= size {
+		return "", "", false
+	}
+	name = strings.Join(parts[:size], "/")
+	return name, file[:ix+len(marker)] + name, true
+}
+
+// Entry describes a single entry in a zip archive, including directories and symlinks
+type Entry struct {
+	Name           string      `json:"name"`
+	Mode           fs.FileMode `json:"mode"`
+	Size           int64       `json:"size"`
+	CompressedSize int64       `json:"compressedSize"`
+	// SHA256 is the hex encoded hash of the entry's uncompressed contents
+	SHA256 string `json:"sha256"`
+	// LinkTarget is where a symlink entry points
+	LinkTarget string `json:"linkTarget,omitempty"`
+}
+
+// Entries lists every entry in the zip archive in data, in the order they're stored
+func Entries(data []byte) ([]Entry, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(r.File))
+	for _, f := range r.File {
+		entry := Entry{
+			Name:           f.Name,
+			Mode:           f.Mode(),
+			Size:           int64(f.UncompressedSize64),
+			CompressedSize: int64(f.CompressedSize64),
+		}
+		if !f.FileInfo().IsDir() {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			sum := sha256.Sum256(content)
+			entry.SHA256 = hex.EncodeToString(sum[:])
+			if entry.Mode&fs.ModeSymlink != 0 {
+				entry.LinkTarget = string(content)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Change kinds reported by Diff
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// Change describes how an entry differs between two archives
+type Change struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	Old  *Entry `json:"old,omitempty"`
+	New  *Entry `json:"new,omitempty"`
+}
+
+// Diff compares the entries of two archives, returning the entries which were added, removed, or whose contents,
+// mode or link target changed, sorted by name
+func Diff(oldEntries []Entry, newEntries []Entry) []Change {
+	oldByName := make(map[string]*Entry, len(oldEntries))
+	for ix := range oldEntries {
+		oldByName[oldEntries[ix].Name] = &oldEntries[ix]
+	}
+	var changes []Change
+	seen := make(map[string]bool, len(newEntries))
+	for ix := range newEntries {
+		newEntry := &newEntries[ix]
+		seen[newEntry.Name] = true
+		oldEntry, ok := oldByName[newEntry.Name]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Name: newEntry.Name, Kind: Added, New: newEntry})
+		case oldEntry.SHA256 != newEntry.SHA256 || oldEntry.Mode != newEntry.Mode || oldEntry.LinkTarget != newEntry.LinkTarget:
+			changes = append(changes, Change{Name: newEntry.Name, Kind: Changed, Old: oldEntry, New: newEntry})
+		}
+	}
+	for ix := range oldEntries {
+		if !seen[oldEntries[ix].Name] {
+			changes = append(changes, Change{Name: oldEntries[ix].Name, Kind: Removed, Old: &oldEntries[ix]})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// ContentHash returns a hex encoded hash of the names, modes, contents and link targets of the entries in the zip
+// archive in data. Unlike a hash of the archive itself, it doesn't depend on modified times, compression or the
+// order of the entries, so two archives of the same files have the same content hash.
+func ContentHash(data []byte) (string, error) {
+	entries, err := Entries(data)
+	if err != nil {
+		return "", err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	h := sha256.New()
+	for _, entry := range entries {
+		fmt.Fprintf(h, "%q %v %s %q\n", entry.Name, entry.Mode, entry.SHA256, entry.LinkTarget)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
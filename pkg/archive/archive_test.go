@@ -0,0 +1,236 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func buildZip(t *testing.T, files map[string]int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, size := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(strings.Repeat("a", size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRead(t *testing.T) {
+	data := buildZip(t, map[string]int{
+		"index.js":                300,
+		"node_modules/a/index.js": 1000,
+		"node_modules/a/big.js":   5000,
+		"node_modules/b/index.js": 2000,
+	})
+	summary, err := Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Zipped != int64(len(data)) {
+		t.Fatalf("Expected zipped size %d, got %d", len(data), summary.Zipped)
+	}
+	if summary.Unzipped != 8300 {
+		t.Fatalf("Expected unzipped size 8300, got %d", summary.Unzipped)
+	}
+	if len(summary.Files) != 4 {
+		t.Fatalf("Expected 4 files, got %v", summary.Files)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	if _, err := Read([]byte("not a zip")); err == nil {
+		t.Fatal("Expected an error reading an invalid zip")
+	}
+}
+
+func TestLargest(t *testing.T) {
+	summary, err := Read(buildZip(t, map[string]int{
+		"index.js":                300,
+		"node_modules/a/index.js": 1000,
+		"node_modules/a/big.js":   5000,
+		"node_modules/b/index.js": 2000,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := summary.LargestFiles(2)
+	if len(files) != 2 || files[0].Name != "node_modules/a/big.js" || files[1].Name != "node_modules/b/index.js" {
+		t.Fatalf("Unexpected largest files: %v", files)
+	}
+	dirs := summary.LargestDirs(-1)
+	if len(dirs) != 3 || dirs[0].Name != "node_modules/" || dirs[0].Size != 8000 || dirs[1].Name != "node_modules/a/" || dirs[1].Size != 6000 || dirs[2].Name != "node_modules/b/" {
+		t.Fatalf("Unexpected largest dirs: %v", dirs)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	function, _ := Read(buildZip(t, map[string]int{"index.js": 100}))
+	layer, _ := Read(buildZip(t, map[string]int{"nodejs/node_modules/a/index.js": 200}))
+	merged := Merge(function, layer)
+	if merged.Unzipped != 300 || merged.Zipped != function.Zipped+layer.Zipped || len(merged.Files) != 2 {
+		t.Fatalf("Unexpected merged summary: %+v", merged)
+	}
+}
+
+func TestTree(t *testing.T) {
+	summary, err := Read(buildZip(t, map[string]int{
+		"index.js":                300,
+		"node_modules/a/index.js": 1000,
+		"node_modules/a/big.js":   5000,
+		"node_modules/b/index.js": 2000,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := summary.Tree()
+	if tree.Size != 8300 || tree.Files != 4 || len(tree.Children) != 2 {
+		t.Fatalf("Unexpected root: %+v", tree)
+	}
+	modules := tree.Children[0]
+	if modules.Path != "node_modules/" || modules.Size != 8000 || modules.Files != 3 {
+		t.Fatalf("Unexpected node_modules node: %+v", modules)
+	}
+	a := modules.Children[0]
+	if a.Name != "a/" || a.Size != 6000 || len(a.Children) != 2 || a.Children[0].Path != "node_modules/a/big.js" {
+		t.Fatalf("Unexpected package node: %+v", a)
+	}
+}
+
+func TestPackages(t *testing.T) {
+	summary, err := Read(buildZip(t, map[string]int{
+		"index.js":                               300,
+		"node_modules/.package-lock.json":        50,
+		"node_modules/a/index.js":                1000,
+		"node_modules/a/node_modules/b/index.js": 4000,
+		"node_modules/@scope/c/lib/index.js":     2000,
+		"node_modules/@scope/c/package.json":     100,
+		"nodejs/node_modules/b/index.js":         500,
+		"src/not_node_modules/x/index.js":        700,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packages := summary.Packages()
+	expected := []Package{
+		{Name: "b", Path: "node_modules/a/node_modules/b", Size: 4000, Files: 1},
+		{Name: "@scope/c", Path: "node_modules/@scope/c", Size: 2100, Files: 2},
+		{Name: "a", Path: "node_modules/a", Size: 1000, Files: 1},
+		{Name: "b", Path: "nodejs/node_modules/b", Size: 500, Files: 1},
+	}
+	if len(packages) != len(expected) {
+		t.Fatalf("Expected %d packages, got %v", len(expected), packages)
+	}
+	for ix, p := range packages {
+		if p.Name != expected[ix].Name || p.Path != expected[ix].Path || p.Size != expected[ix].Size || p.Files != expected[ix].Files {
+			t.Fatalf("Expected %+v, got %+v", expected[ix], p)
+		}
+	}
+}
+
+func TestEntries(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	header := &zip.FileHeader{Name: "bootstrap"}
+	header.SetMode(0755)
+	f, _ := w.CreateHeader(header)
+	f.Write([]byte("binary"))
+	link := &zip.FileHeader{Name: "node_modules"}
+	link.SetMode(fs.ModeSymlink | 0777)
+	f, _ = w.CreateHeader(link)
+	f.Write([]byte("/opt/nodejs/node_modules"))
+	w.Create("lib/")
+	w.Close()
+
+	entries, err := Entries(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %v", entries)
+	}
+	if entries[0].Mode != 0755 || entries[0].Size != 6 || entries[0].SHA256 == "" {
+		t.Fatalf("Unexpected file entry: %+v", entries[0])
+	}
+	if entries[1].LinkTarget != "/opt/nodejs/node_modules" {
+		t.Fatalf("Unexpected symlink entry: %+v", entries[1])
+	}
+	if !entries[2].Mode.IsDir() || entries[2].SHA256 != "" {
+		t.Fatalf("Unexpected directory entry: %+v", entries[2])
+	}
+}
+
+func TestDiff(t *testing.T) {
+	oldEntries := []Entry{
+		{Name: "a.js", Mode: 0644, SHA256: "1"},
+		{Name: "b.js", Mode: 0644, SHA256: "2"},
+		{Name: "c.js", Mode: 0644, SHA256: "3"},
+		{Name: "run", Mode: 0644, SHA256: "4"},
+	}
+	newEntries := []Entry{
+		{Name: "a.js", Mode: 0644, SHA256: "1"},
+		{Name: "c.js", Mode: 0644, SHA256: "changed"},
+		{Name: "d.js", Mode: 0644, SHA256: "5"},
+		{Name: "run", Mode: 0755, SHA256: "4"},
+	}
+	changes := Diff(oldEntries, newEntries)
+	expected := []Change{
+		{Name: "b.js", Kind: Removed},
+		{Name: "c.js", Kind: Changed},
+		{Name: "d.js", Kind: Added},
+		{Name: "run", Kind: Changed},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes, got %v", len(expected), changes)
+	}
+	for ix, change := range changes {
+		if change.Name != expected[ix].Name || change.Kind != expected[ix].Kind {
+			t.Fatalf("Expected %s %s, got %s %s", expected[ix].Kind, expected[ix].Name, change.Kind, change.Name)
+		}
+	}
+	if len(Diff(oldEntries, oldEntries)) != 0 {
+		t.Fatal("Expected no changes between identical archives")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	build := func(modified time.Time, method uint16, files ...string) []byte {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		for _, name := range files {
+			f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modified})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte("content of " + name))
+		}
+		w.Close()
+		return buf.Bytes()
+	}
+	hash := func(data []byte) string {
+		h, err := ContentHash(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	original := hash(build(time.Now(), zip.Deflate, "a.js", "b.js"))
+	if rebuilt := hash(build(time.Now().Add(time.Hour), zip.Store, "b.js", "a.js")); rebuilt != original {
+		t.Fatal("Expected the same files to have the same content hash")
+	}
+	if changed := hash(build(time.Now(), zip.Deflate, "a.js", "c.js")); changed == original {
+		t.Fatal("Expected different files to have a different content hash")
+	}
+}
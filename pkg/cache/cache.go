@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const extension = ".zip"
+
+// Cache stores built archives on disk by key, so an archive whose inputs haven't changed can be reused rather
+// than compressed again
+type Cache struct {
+	Dir string
+}
+
+// Entry describes an archive in the cache
+type Entry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// New returns a cache which keeps archives in dir
+func New(dir string) *Cache {
+	return &Cache{Dir: dir}
+}
+
+// Default returns the cache in the user's cache directory, eg $XDG_CACHE_HOME/fn-push on linux
+func Default() (*Cache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return New(filepath.Join(dir, "fn-push")), nil
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, key+extension)
+}
+
+// Get returns the archive stored under key, if there is one, and marks it as used
+func (c *Cache) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(c.path(key), now, now)
+	return data, true
+}
+
+// Put stores an archive under key. The archive is written to a temporary file first, so a concurrent Get never
+// sees half an archive.
+func (c *Cache) Put(key string, data []byte) error {
+	err := os.MkdirAll(c.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.Dir, key+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+// List returns the archives in the cache, most recently used first
+func (c *Cache) List() ([]Entry, error) {
+	dirEntries, err := os.ReadDir(c.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, dirEntry := range dirEntries {
+		key, ok := strings.CutSuffix(dirEntry.Name(), extension)
+		if !ok || dirEntry.IsDir() {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{Key: key, Size: info.Size(), LastUsed: info.ModTime()})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Clean removes the archives which haven't been used within maxAge of now, or all of them if maxAge is 0, and
+// returns the entries it removed
+func (c *Cache) Clean(maxAge time.Duration, now time.Time) ([]Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var removed []Entry
+	for _, entry := range entries {
+		if maxAge > 0 && now.Sub(entry.LastUsed) <= maxAge {
+			continue
+		}
+		err = os.Remove(c.path(entry.Key))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, err
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
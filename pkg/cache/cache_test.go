@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGetPut(t *testing.T) {
+	c := New(filepath.Join(t.TempDir(), "fn-push"))
+	if _, ok := c.Get("abc"); ok {
+		t.Fatal("Expected a miss from an empty cache")
+	}
+	if err := c.Put("abc", []byte("archive")); err != nil {
+		t.Fatal(err)
+	}
+	data, ok := c.Get("abc")
+	if !ok || string(data) != "archive" {
+		t.Fatalf("Expected a hit, got %q %v", data, ok)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(c.Dir, "*.tmp"))
+	if len(leftovers) != 0 {
+		t.Fatalf("Expected no temporary files, got %v", leftovers)
+	}
+}
+
+func TestListAndClean(t *testing.T) {
+	c := New(t.TempDir())
+	now := time.Now()
+	for key, age := range map[string]time.Duration{"old": 48 * time.Hour, "new": time.Hour} {
+		if err := c.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		used := now.Add(-age)
+		if err := os.Chtimes(c.path(key), used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(c.Dir, "unrelated.txt"), []byte("x"), 0644)
+
+	entries, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "new" || entries[1].Key != "old" || entries[1].Size != 3 {
+		t.Fatalf("Unexpected entries: %v", entries)
+	}
+
+	removed, err := c.Clean(24*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Key != "old" {
+		t.Fatalf("Unexpected removed entries: %v", removed)
+	}
+	removed, err = c.Clean(0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Key != "new" {
+		t.Fatalf("Unexpected removed entries: %v", removed)
+	}
+}
+
+func TestListMissingDir(t *testing.T) {
+	entries, err := New(filepath.Join(t.TempDir(), "missing")).List()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Expected no entries, got %v %v", entries, err)
+	}
+}
@@ -0,0 +1,125 @@
+package clean
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// Rule is a named set of globs describing files in node_modules packages which aren't needed at runtime. The globs
+// are matched against the path of the file within node_modules.
+type Rule struct {
+	Name     string
+	Patterns []string
+}
+
+// DefaultRules is the curated set of rules used unless overridden
+var DefaultRules = []Rule{
+	{Name: "docs", Patterns: append([]string{"**/README*", "**/readme*", "**/CHANGELOG*", "**/changelog*", "**/HISTORY*", "**/AUTHORS*", "**/CONTRIBUTING*", "**/*.md", "**/*.markdown"}, packageDirs("docs", "doc")...)},
+	{Name: "tests", Patterns: append([]string{"**/*.test.js", "**/*.spec.js"}, packageDirs("test", "tests", "__tests__", "__mocks__")...)},
+	{Name: "types", Patterns: []string{"**/*.d.ts", "**/*.d.mts", "**/*.d.cts"}},
+	{Name: "sourcemaps", Patterns: []string{"**/*.map"}},
+	{Name: "examples", Patterns: packageDirs("example", "examples")},
+	{Name: "configs", Patterns: append([]string{"**/.eslintrc*", "**/.prettierrc*", "**/.editorconfig", "**/.travis.yml", "**/.npmignore", "**/tsconfig.json"}, packageDirs(".github")...)},
+}
+
+// Keep lists files which are never removed, whatever the rules match, since licences have to ship with the code
+var Keep = []string{"**/LICEN[CS]E*", "**/licen[cs]e*", "**/COPYING*", "**/copying*"}
+
+// Builds globs matching everything in the named directories inside a package, but not a package with that name.
+// Paths are relative to node_modules, so the first segment (or two, for scoped packages) is the package itself.
+func packageDirs(names ...string) []string {
+	var patterns []string
+	for _, name := range names {
+		patterns = append(patterns, "[!@]*/**/"+name+"/**", "@*/*/**/"+name+"/**")
+	}
+	return patterns
+}
+
+// Saving records how much a rule removed
+type Saving struct {
+	Rule  string `json:"rule"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Cleaner filters junk out of node_modules, keeping track of how much each rule removed
+type Cleaner struct {
+	rules   []Rule
+	savings map[string]*Saving
+}
+
+// Rules returns the default rules, less any named in skip, plus a "custom" rule made of any extra patterns
+func Rules(skip []string, extra []string) ([]Rule, error) {
+	var rules []Rule
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	for _, rule := range DefaultRules {
+		if skipped[rule.Name] {
+			delete(skipped, rule.Name)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	for name := range skipped {
+		return nil, fmt.Errorf("unknown clean rule '%s'", name)
+	}
+	if len(extra) > 0 {
+		rules = append(rules, Rule{Name: "custom", Patterns: extra})
+	}
+	return rules, nil
+}
+
+// New creates a cleaner which filters with the given rules
+func New(rules []Rule) *Cleaner {
+	return &Cleaner{
+		rules:   rules,
+		savings: make(map[string]*Saving),
+	}
+}
+
+// Include reports whether a slash separated file path should be kept. Only files inside node_modules are removed.
+// The size is counted towards the rule's saving when the file is removed. It comes from the caller, since a file in
+// a pnpm or yarn plug'n'play install isn't at the path it has in the flattened node_modules.
+func (c *Cleaner) Include(file string, size int64) bool {
+	ix := strings.LastIndex(file, "node_modules/")
+	if ix == -1 {
+		return true
+	}
+	rel := file[ix+len("node_modules/"):]
+	for _, pattern := range Keep {
+		if ok, _ := doublestar.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	for _, rule := range c.rules {
+		for _, pattern := range rule.Patterns {
+			if ok, _ := doublestar.Match(pattern, rel); !ok {
+				continue
+			}
+			saving, ok := c.savings[rule.Name]
+			if !ok {
+				saving = &Saving{Rule: rule.Name}
+				c.savings[rule.Name] = saving
+			}
+			saving.Files++
+			saving.Bytes += size
+			return false
+		}
+	}
+	return true
+}
+
+// Report returns what each rule removed, in rule order
+func (c *Cleaner) Report() []Saving {
+	var report []Saving
+	for _, rule := range c.rules {
+		if saving, ok := c.savings[rule.Name]; ok {
+			report = append(report, *saving)
+		}
+	}
+	return report
+}
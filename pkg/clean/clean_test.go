@@ -0,0 +1,94 @@
+package clean
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+var testFS = fstest.MapFS{
+	"index.js":                           {Data: []byte("app")},
+	"README.md":                          {Data: []byte("app readme")},
+	"node_modules/a/index.js":            {Data: []byte("module.exports = 1")},
+	"node_modules/a/README.md":           {Data: []byte("readme")},
+	"node_modules/a/index.d.ts":          {Data: []byte("types")},
+	"node_modules/a/index.js.map":        {Data: []byte("map")},
+	"node_modules/a/test/index.test.js":  {Data: []byte("test")},
+	"node_modules/@s/b/lib/index.js":     {Data: []byte("module.exports = 2")},
+	"node_modules/@s/b/CHANGELOG.md":     {Data: []byte("changes")},
+	"node_modules/@s/b/fixtures/data.db": {Data: []byte("fixture")},
+	"node_modules/@s/b/LICENSE.md":       {Data: []byte("licence")},
+	"node_modules/c/COPYING.md":          {Data: []byte("licence")},
+	"node_modules/test/index.js":         {Data: []byte("module.exports = 3")},
+	"node_modules/test/test/index.js":    {Data: []byte("test")},
+	"node_modules/@s/docs/index.js":      {Data: []byte("module.exports = 4")},
+	"node_modules/@s/docs/docs/api.html": {Data: []byte("docs")},
+}
+
+func TestDefaultRules(t *testing.T) {
+	rules, err := Rules(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(rules)
+	cases := map[string]bool{
+		"index.js":                           true,
+		"README.md":                          true,
+		"node_modules/a/index.js":            true,
+		"node_modules/a/README.md":           false,
+		"node_modules/a/index.d.ts":          false,
+		"node_modules/a/index.js.map":        false,
+		"node_modules/a/test/index.test.js":  false,
+		"node_modules/@s/b/lib/index.js":     true,
+		"node_modules/@s/b/CHANGELOG.md":     false,
+		"node_modules/@s/b/fixtures/data.db": true,
+		"node_modules/@s/b/LICENSE.md":       true,
+		"node_modules/c/COPYING.md":          true,
+		"node_modules/test/index.js":         true,
+		"node_modules/test/test/index.js":    false,
+		"node_modules/@s/docs/index.js":      true,
+		"node_modules/@s/docs/docs/api.html": false,
+	}
+	for file, expected := range cases {
+		if actual := c.Include(file, int64(len(testFS[file].Data))); actual != expected {
+			t.Fatalf("%s: expected %v, actual %v", file, expected, actual)
+		}
+	}
+
+	report := c.Report()
+	if len(report) != 4 {
+		t.Fatal("report", report)
+	}
+	docs := report[0]
+	if docs.Rule != "docs" || docs.Files != 3 || docs.Bytes != int64(len("readme")+len("changes")+len("docs")) {
+		t.Fatal("docs", docs)
+	}
+}
+
+func TestSkipAndExtraRules(t *testing.T) {
+	rules, err := Rules([]string{"types", "tests"}, []string{"**/fixtures/**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(rules)
+	cases := map[string]bool{
+		"node_modules/a/index.d.ts":          true,
+		"node_modules/a/test/index.test.js":  true,
+		"node_modules/@s/b/fixtures/data.db": false,
+	}
+	for file, expected := range cases {
+		if actual := c.Include(file, int64(len(testFS[file].Data))); actual != expected {
+			t.Fatalf("%s: expected %v, actual %v", file, expected, actual)
+		}
+	}
+	report := c.Report()
+	if len(report) != 1 || report[0].Rule != "custom" {
+		t.Fatal("report", report)
+	}
+}
+
+func TestUnknownRule(t *testing.T) {
+	_, err := Rules([]string{"nope"}, nil)
+	if err == nil {
+		t.Fatal("Expected an error for an unknown rule")
+	}
+}
@@ -0,0 +1,148 @@
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+type pattern struct {
+	// dir is the directory containing the ignore file the pattern came from, relative to the root
+	dir     string
+	glob    string
+	negate  bool
+	dirOnly bool
+}
+
+// Matcher decides whether paths are ignored using patterns with gitignore semantics
+type Matcher struct {
+	patterns []pattern
+}
+
+// Reads gitignore style patterns from a reader. The dir is the location of the ignore file relative to the
+// root of the tree being matched, and the patterns only apply to paths within it.
+func parse(r io.Reader, dir string) ([]pattern, error) {
+	var patterns []pattern
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := trimTrailingSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := pattern{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		// patterns with a slash anywhere but the end are relative to the ignore file, others match at any depth
+		if strings.Contains(line, "/") {
+			p.glob = strings.TrimPrefix(line, "/")
+		} else {
+			p.glob = "**/" + line
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, scanner.Err()
+}
+
+// Removes unescaped trailing spaces from a line
+func trimTrailingSpace(line string) string {
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	return strings.ReplaceAll(line, `\ `, " ")
+}
+
+// Load walks a filesystem collecting patterns from every ignore file with one of the given names, so nested ignore
+// files apply to their own directories. Directories which are already ignored aren't searched.
+func Load(fsys fs.FS, fileNames []string) (*Matcher, error) {
+	m := &Matcher{}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if p != "." && m.Match(p, true) {
+			return fs.SkipDir
+		}
+		return m.AddDir(fsys, p, fileNames)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AddDir reads the patterns from any ignore files with one of the given names in a slash separated directory of
+// the filesystem, so a matcher can be built up while walking a tree rather than with a walk of its own. The
+// patterns only apply to paths within dir, which should be "." for the root.
+func (m *Matcher) AddDir(fsys fs.FS, dir string, fileNames []string) error {
+	for _, name := range fileNames {
+		file, err := fsys.Open(path.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		patterns, err := parse(file, dir)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		m.patterns = append(m.patterns, patterns...)
+	}
+	return nil
+}
+
+// Returns whether the last pattern matching a path ignores it
+func (m *Matcher) matchOne(p string, isDir bool) bool {
+	ignored := false
+	for _, pattern := range m.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		rel := p
+		if pattern.dir != "." {
+			if !strings.HasPrefix(p, pattern.dir+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(p, pattern.dir+"/")
+		}
+		if ok, _ := doublestar.Match(pattern.glob, rel); ok {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
+
+// Match reports whether a slash separated path, relative to the root the matcher was loaded from, is ignored. As
+// with git, a path inside an ignored directory is ignored and can't be re-included by a negated pattern.
+func (m *Matcher) Match(p string, isDir bool) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+	parts := strings.Split(p, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.matchOne(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.matchOne(p, isDir)
+}
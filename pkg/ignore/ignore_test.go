@@ -0,0 +1,113 @@
+package ignore
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func testMatcher(t *testing.T, files map[string]string) *Matcher {
+	fsys := fstest.MapFS{}
+	for name, content := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	m, err := Load(fsys, []string{".gitignore", ".fnpushignore"})
+	if err != nil {
+		t.Fatal("Error loading ignore files", err)
+	}
+	return m
+}
+
+func TestNoIgnoreFiles(t *testing.T) {
+	m := testMatcher(t, map[string]string{"index.js": ""})
+	if m.Match("index.js", false) {
+		t.Fatal("nothing should be ignored")
+	}
+}
+
+func TestUnanchoredPatterns(t *testing.T) {
+	m := testMatcher(t, map[string]string{
+		".gitignore": "# build output\n*.log\n.env\n",
+	})
+	cases := map[string]bool{
+		"debug.log":         true,
+		"logs/debug.log":    true,
+		".env":              true,
+		"config/.env":       true,
+		"index.js":          false,
+		"logs/debug.log.js": false,
+	}
+	for path, expected := range cases {
+		if actual := m.Match(path, false); actual != expected {
+			t.Fatalf("%s: expected %v, actual %v", path, expected, actual)
+		}
+	}
+}
+
+func TestAnchoredAndDirectoryPatterns(t *testing.T) {
+	m := testMatcher(t, map[string]string{
+		".gitignore": "/dist\ncache/\ndocs/*.md\n",
+	})
+	cases := map[string]bool{
+		"dist/index.js":      true,
+		"src/dist/index.js":  false,
+		"cache/entry":        true,
+		"src/cache/entry":    true,
+		"cache":              false,
+		"docs/README.md":     true,
+		"docs/api/README.md": false,
+	}
+	for path, expected := range cases {
+		if actual := m.Match(path, false); actual != expected {
+			t.Fatalf("%s: expected %v, actual %v", path, expected, actual)
+		}
+	}
+}
+
+func TestNegation(t *testing.T) {
+	m := testMatcher(t, map[string]string{
+		".fnpushignore": "*.json\n!package.json\nbuild/\n!build/keep.json\n",
+	})
+	cases := map[string]bool{
+		"tsconfig.json":    true,
+		"package.json":     false,
+		"lib/package.json": false,
+		"build/keep.json":  true,
+	}
+	for path, expected := range cases {
+		if actual := m.Match(path, false); actual != expected {
+			t.Fatalf("%s: expected %v, actual %v", path, expected, actual)
+		}
+	}
+}
+
+func TestNestedIgnoreFiles(t *testing.T) {
+	m := testMatcher(t, map[string]string{
+		".gitignore":         "*.tmp\n",
+		"src/.gitignore":     "/generated\n!keep.tmp\n",
+		"src/generated/a.js": "",
+	})
+	cases := map[string]bool{
+		"generated/a.js":     false,
+		"src/generated/a.js": true,
+		"a.tmp":              true,
+		"src/a.tmp":          true,
+		"src/keep.tmp":       false,
+		"keep.tmp":           true,
+	}
+	for path, expected := range cases {
+		if actual := m.Match(path, false); actual != expected {
+			t.Fatalf("%s: expected %v, actual %v", path, expected, actual)
+		}
+	}
+}
+
+func TestIgnoredDirectoriesArentSearched(t *testing.T) {
+	m := testMatcher(t, map[string]string{
+		".gitignore":              "node_modules/\n",
+		"node_modules/.gitignore": "!*\n",
+		"node_modules/foo/a.js":   "",
+	})
+	if !m.Match("node_modules/foo/a.js", false) {
+		t.Fatal("node_modules should be ignored")
+	}
+}
@@ -0,0 +1,266 @@
+package nodedeps
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Filter decides which files under node_modules belong to production dependencies
+type Filter struct {
+	// paths holds the package directories npm marks as production dependencies, eg node_modules/a/node_modules/b
+	paths map[string]bool
+	// names holds the names of production packages, for lockfiles which don't describe the node_modules layout
+	names map[string]bool
+}
+
+type packageJSON struct {
+	Dependencies         map[string]string `json:"dependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+}
+
+// Load reads package.json and whichever lockfile is present (package-lock.json, npm-shrinkwrap.json,
+// pnpm-lock.yaml or yarn.lock) from the root of a project and computes its production dependencies
+func Load(fsys fs.FS) (*Filter, error) {
+	for _, name := range []string{"package-lock.json", "npm-shrinkwrap.json"} {
+		data, err := fs.ReadFile(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return loadNpmLock(data)
+	}
+
+	data, err := fs.ReadFile(fsys, "package.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package.json: %w", err)
+	}
+	var pkg packageJSON
+	err = json.Unmarshal(data, &pkg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse package.json: %w", err)
+	}
+
+	var graph map[string][]string
+	if data, err = fs.ReadFile(fsys, "pnpm-lock.yaml"); err == nil {
+		graph, err = parsePnpmLock(data)
+	} else if data, err = fs.ReadFile(fsys, "yarn.lock"); err == nil {
+		graph, err = parseYarnLock(data)
+	} else {
+		return nil, errors.New("no package-lock.json, npm-shrinkwrap.json, pnpm-lock.yaml or yarn.lock found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	var queue []string
+	for name := range pkg.Dependencies {
+		queue = append(queue, name)
+	}
+	for name := range pkg.OptionalDependencies {
+		queue = append(queue, name)
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if names[name] {
+			continue
+		}
+		names[name] = true
+		queue = append(queue, graph[name]...)
+	}
+	return &Filter{names: names}, nil
+}
+
+type npmLock struct {
+	Packages     map[string]npmLockPackage    `json:"packages"`
+	Dependencies map[string]npmLockDependency `json:"dependencies"`
+}
+
+type npmLockPackage struct {
+	Dev bool `json:"dev"`
+}
+
+type npmLockDependency struct {
+	Dev          bool                         `json:"dev"`
+	Dependencies map[string]npmLockDependency `json:"dependencies"`
+}
+
+// Reads the production package directories from an npm lockfile. Version 2 and 3 lockfiles list every package
+// directory, version 1 lockfiles nest dependencies the way they're laid out on disk.
+func loadNpmLock(data []byte) (*Filter, error) {
+	var lock npmLock
+	err := json.Unmarshal(data, &lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse npm lockfile: %w", err)
+	}
+	paths := make(map[string]bool)
+	if lock.Packages != nil {
+		for path, pkg := range lock.Packages {
+			if path != "" && !pkg.Dev {
+				paths[path] = true
+			}
+		}
+		return &Filter{paths: paths}, nil
+	}
+	var walk func(prefix string, deps map[string]npmLockDependency)
+	walk = func(prefix string, deps map[string]npmLockDependency) {
+		for name, pkg := range deps {
+			if pkg.Dev {
+				continue
+			}
+			path := prefix + "node_modules/" + name
+			paths[path] = true
+			walk(path+"/", pkg.Dependencies)
+		}
+	}
+	walk("", lock.Dependencies)
+	return &Filter{paths: paths}, nil
+}
+
+// Returns the package name from a lockfile descriptor like name@^1.0.0, @scope/name@npm:1.0.0 or name@1.0.0(peer@2.0.0)
+func nameFromDescriptor(descriptor string) string {
+	descriptor = strings.Trim(strings.TrimSpace(descriptor), `"`)
+	descriptor = strings.TrimPrefix(descriptor, "/")
+	ix := strings.Index(descriptor[min(1, len(descriptor)):], "@")
+	if ix == -1 {
+		return descriptor
+	}
+	return descriptor[:ix+1]
+}
+
+type pnpmLock struct {
+	LockfileVersion interface{}                `yaml:"lockfileVersion"`
+	Packages        map[string]pnpmLockPackage `yaml:"packages"`
+	Snapshots       map[string]pnpmLockPackage `yaml:"snapshots"`
+}
+
+type pnpmLockPackage struct {
+	Dependencies         map[string]interface{} `yaml:"dependencies"`
+	OptionalDependencies map[string]interface{} `yaml:"optionalDependencies"`
+}
+
+// Reads the dependency graph, keyed on package name, from a pnpm lockfile
+func parsePnpmLock(data []byte) (map[string][]string, error) {
+	var lock pnpmLock
+	err := yaml.Unmarshal(data, &lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pnpm-lock.yaml: %w", err)
+	}
+	// version 5 lockfiles key packages like /@scope/name/1.0.0, later versions use /@scope/name@1.0.0
+	v5 := strings.HasPrefix(fmt.Sprint(lock.LockfileVersion), "5")
+	graph := make(map[string][]string)
+	for _, packages := range []map[string]pnpmLockPackage{lock.Packages, lock.Snapshots} {
+		for key, pkg := range packages {
+			name := nameFromDescriptor(key)
+			if v5 {
+				key = strings.TrimPrefix(key, "/")
+				name = key[:max(strings.LastIndex(key, "/"), 0)]
+			}
+			for dep := range pkg.Dependencies {
+				graph[name] = append(graph[name], dep)
+			}
+			for dep := range pkg.OptionalDependencies {
+				graph[name] = append(graph[name], dep)
+			}
+		}
+	}
+	return graph, nil
+}
+
+type yarnBerryPackage struct {
+	Dependencies         map[string]string `yaml:"dependencies"`
+	OptionalDependencies map[string]string `yaml:"optionalDependencies"`
+}
+
+// Reads the dependency graph, keyed on package name, from a yarn lockfile. Yarn 2+ lockfiles are YAML, yarn 1
+// lockfiles use their own indentation based format.
+func parseYarnLock(data []byte) (map[string][]string, error) {
+	graph := make(map[string][]string)
+	if bytes.Contains(data, []byte("__metadata:")) {
+		var lock map[string]yarnBerryPackage
+		err := yaml.Unmarshal(data, &lock)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse yarn.lock: %w", err)
+		}
+		for key, pkg := range lock {
+			if key == "__metadata" {
+				continue
+			}
+			for _, descriptor := range strings.Split(key, ",") {
+				name := nameFromDescriptor(descriptor)
+				for dep := range pkg.Dependencies {
+					graph[name] = append(graph[name], dep)
+				}
+				for dep := range pkg.OptionalDependencies {
+					graph[name] = append(graph[name], dep)
+				}
+			}
+		}
+		return graph, nil
+	}
+
+	var names []string
+	inDependencies := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		switch {
+		case indent == 0:
+			names = nil
+			for _, descriptor := range strings.Split(strings.TrimSuffix(trimmed, ":"), ",") {
+				names = append(names, nameFromDescriptor(descriptor))
+			}
+			inDependencies = false
+		case indent == 2:
+			inDependencies = trimmed == "dependencies:" || trimmed == "optionalDependencies:"
+		case inDependencies:
+			dep := strings.Trim(strings.Fields(trimmed)[0], `"`)
+			for _, name := range names {
+				graph[name] = append(graph[name], dep)
+			}
+		}
+	}
+	return graph, scanner.Err()
+}
+
+// Include reports whether a slash separated file path, relative to the project root, should be bundled. Files
+// outside node_modules are always included, files inside it only if they belong to a production package.
+func (f *Filter) Include(file string) bool {
+	parts := strings.Split(file, "/")
+	packageDir := ""
+	name := ""
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] != "node_modules" {
+			continue
+		}
+		end := i + 2
+		if strings.HasPrefix(parts[i+1], "@") && i+2 < len(parts)-1 {
+			end = i + 3
+		}
+		name = strings.Join(parts[i+1:end], "/")
+		packageDir = strings.Join(parts[:end], "/")
+		i = end - 1
+	}
+	if packageDir == "" {
+		return true
+	}
+	if f.paths != nil {
+		return f.paths[packageDir]
+	}
+	return f.names[name]
+}
@@ -0,0 +1,197 @@
+package nodedeps
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func testFilter(t *testing.T, files map[string]string) *Filter {
+	fsys := fstest.MapFS{}
+	for name, content := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	f, err := Load(fsys)
+	if err != nil {
+		t.Fatal("Error loading dependencies", err)
+	}
+	return f
+}
+
+func assertIncludes(t *testing.T, f *Filter, cases map[string]bool) {
+	for file, expected := range cases {
+		if actual := f.Include(file); actual != expected {
+			t.Fatalf("%s: expected %v, actual %v", file, expected, actual)
+		}
+	}
+}
+
+func TestNpmLockfile(t *testing.T) {
+	f := testFilter(t, map[string]string{
+		"package-lock.json": `{
+			"lockfileVersion": 3,
+			"packages": {
+				"": {"dependencies": {"a": "^1.0.0"}, "devDependencies": {"jest": "^29.0.0"}},
+				"node_modules/a": {"version": "1.0.0"},
+				"node_modules/a/node_modules/b": {"version": "2.0.0"},
+				"node_modules/@scope/c": {"version": "1.0.0"},
+				"node_modules/jest": {"version": "29.0.0", "dev": true},
+				"node_modules/jest/node_modules/b": {"version": "1.0.0", "dev": true}
+			}
+		}`,
+	})
+	assertIncludes(t, f, map[string]bool{
+		"index.js":                               true,
+		"lib/node_modules.js":                    true,
+		"node_modules/a/index.js":                true,
+		"node_modules/a/node_modules/b/index.js": true,
+		"node_modules/@scope/c/lib/index.js":     true,
+		"node_modules/jest/index.js":             false,
+		"node_modules/jest/node_modules/b/x.js":  false,
+		"node_modules/.package-lock.json":        false,
+	})
+}
+
+func TestNpmLockfileVersion1(t *testing.T) {
+	f := testFilter(t, map[string]string{
+		"package-lock.json": `{
+			"lockfileVersion": 1,
+			"dependencies": {
+				"a": {"version": "1.0.0", "dependencies": {"b": {"version": "2.0.0"}}},
+				"jest": {"version": "29.0.0", "dev": true}
+			}
+		}`,
+	})
+	assertIncludes(t, f, map[string]bool{
+		"node_modules/a/index.js":                true,
+		"node_modules/a/node_modules/b/index.js": true,
+		"node_modules/jest/index.js":             false,
+	})
+}
+
+func TestPnpmLockfile(t *testing.T) {
+	f := testFilter(t, map[string]string{
+		"package.json": `{"dependencies": {"a": "^1.0.0"}, "devDependencies": {"jest": "^29.0.0"}}`,
+		"pnpm-lock.yaml": `lockfileVersion: '9.0'
+importers:
+  .:
+    dependencies:
+      a:
+        specifier: ^1.0.0
+        version: 1.0.0
+packages:
+  a@1.0.0:
+    resolution: {integrity: sha512-a}
+  '@scope/b@2.0.0':
+    resolution: {integrity: sha512-b}
+  jest@29.0.0:
+    resolution: {integrity: sha512-jest}
+snapshots:
+  a@1.0.0:
+    dependencies:
+      '@scope/b': 2.0.0
+  '@scope/b@2.0.0': {}
+  jest@29.0.0:
+    dependencies:
+      c: 1.0.0
+`,
+	})
+	assertIncludes(t, f, map[string]bool{
+		"node_modules/a/index.js":                                   true,
+		"node_modules/@scope/b/index.js":                            true,
+		"node_modules/.pnpm/a@1.0.0/node_modules/a/index.js":        true,
+		"node_modules/.pnpm/jest@29.0.0/node_modules/jest/index.js": false,
+		"node_modules/jest/index.js":                                false,
+		"node_modules/c/index.js":                                   false,
+	})
+}
+
+func TestPnpmLockfileVersion5(t *testing.T) {
+	f := testFilter(t, map[string]string{
+		"package.json": `{"dependencies": {"a": "^1.0.0"}}`,
+		"pnpm-lock.yaml": `lockfileVersion: 5.4
+dependencies:
+  a: 1.0.0
+packages:
+  /a/1.0.0:
+    dependencies:
+      '@scope/b': 2.0.0
+    dev: false
+  /@scope/b/2.0.0:
+    dev: false
+  /jest/29.0.0:
+    dev: true
+`,
+	})
+	assertIncludes(t, f, map[string]bool{
+		"node_modules/a/index.js":        true,
+		"node_modules/@scope/b/index.js": true,
+		"node_modules/jest/index.js":     false,
+	})
+}
+
+func TestYarnLockfile(t *testing.T) {
+	f := testFilter(t, map[string]string{
+		"package.json": `{"dependencies": {"a": "^1.0.0"}, "optionalDependencies": {"fsevents": "^2.0.0"}}`,
+		"yarn.lock": `# THIS IS AN AUTOGENERATED FILE. DO NOT EDIT THIS FILE DIRECTLY.
+# yarn lockfile v1
+
+
+a@^1.0.0:
+  version "1.0.0"
+  resolved "https://registry.yarnpkg.com/a/-/a-1.0.0.tgz"
+  dependencies:
+    "@scope/b" "^2.0.0"
+
+"@scope/b@^2.0.0", "@scope/b@^2.1.0":
+  version "2.1.0"
+
+fsevents@^2.0.0:
+  version "2.3.0"
+
+jest@^29.0.0:
+  version "29.0.0"
+  dependencies:
+    c "^1.0.0"
+`,
+	})
+	assertIncludes(t, f, map[string]bool{
+		"node_modules/a/index.js":        true,
+		"node_modules/@scope/b/index.js": true,
+		"node_modules/fsevents/index.js": true,
+		"node_modules/jest/index.js":     false,
+		"node_modules/c/index.js":        false,
+	})
+}
+
+func TestYarnBerryLockfile(t *testing.T) {
+	f := testFilter(t, map[string]string{
+		"package.json": `{"dependencies": {"a": "^1.0.0"}}`,
+		"yarn.lock": `__metadata:
+  version: 6
+  cacheKey: 8
+
+"a@npm:^1.0.0":
+  version: 1.0.0
+  dependencies:
+    "@scope/b": "npm:^2.0.0"
+
+"@scope/b@npm:^2.0.0":
+  version: 2.0.0
+
+"jest@npm:^29.0.0":
+  version: 29.0.0
+`,
+	})
+	assertIncludes(t, f, map[string]bool{
+		"node_modules/a/index.js":        true,
+		"node_modules/@scope/b/index.js": true,
+		"node_modules/jest/index.js":     false,
+	})
+}
+
+func TestMissingLockfile(t *testing.T) {
+	_, err := Load(fstest.MapFS{"package.json": &fstest.MapFile{Data: []byte(`{}`)}})
+	if err == nil {
+		t.Fatal("Expected an error without a lockfile")
+	}
+}
@@ -0,0 +1,483 @@
+package nodelayout
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Layout is the way a package manager installs dependencies
+type Layout string
+
+const (
+	// NPM is a flat node_modules of real directories, as installed by npm or yarn's node-modules linker
+	NPM Layout = "npm"
+	// PNPM is a node_modules of symlinks into node_modules/.pnpm, where each package's dependencies are symlinked
+	// in next to it
+	PNPM Layout = "pnpm"
+	// PnP is yarn's plug'n'play, where there's no node_modules and .pnp.cjs maps packages to zips in .yarn/cache
+	PnP Layout = "pnp"
+)
+
+// Detect works out which layout the dependencies in root were installed with
+func Detect(root string) Layout {
+	if _, err := os.Stat(filepath.Join(root, "node_modules", ".pnpm")); err == nil {
+		return PNPM
+	}
+	if _, err := os.Stat(filepath.Join(root, "node_modules")); err == nil {
+		return NPM
+	}
+	for _, name := range []string{".pnp.data.json", ".pnp.cjs", ".pnp.js"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+			return PnP
+		}
+	}
+	return NPM
+}
+
+// File is a file from an installed package, and where it belongs in a flat node_modules
+type File struct {
+	// FS holds the package, either a directory or a zip from the yarn cache
+	FS fs.FS
+	// Path is the slash separated path of the file within FS
+	Path string
+	// Name is the path of the file in the flat layout, eg node_modules/a/index.js
+	Name string
+}
+
+// pkg is a single installed copy of a package
+type pkg struct {
+	Name string
+	// fsys and dir locate the package's files
+	fsys fs.FS
+	dir  string
+	// id tells apart different copies of the same package, eg different versions
+	id   string
+	deps []*pkg
+}
+
+// Materialize builds a flat node_modules from the dependencies installed in root, hoisting packages to the top
+// level where they don't clash and nesting them under the package which needs them where they do, the way npm
+// would. It returns the files to add to the layer in a stable order.
+func Materialize(root string, layout Layout) ([]File, error) {
+	var roots []*pkg
+	var err error
+	switch layout {
+	case PNPM:
+		roots, err = pnpmPackages(root)
+	case PnP:
+		roots, err = pnpPackages(root)
+	default:
+		return nil, fmt.Errorf("the %s layout is already flat", layout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	for _, placement := range hoist(roots) {
+		err = fs.WalkDir(placement.Package.fsys, placement.Package.dir, func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type()&fs.ModeSymlink != 0 {
+				// links inside a package, eg .bin entries, are only kept if they point at a file
+				info, err := fs.Stat(placement.Package.fsys, file)
+				if err != nil || info.IsDir() {
+					return nil
+				}
+			} else if d.IsDir() {
+				return nil
+			}
+			rel := file
+			if placement.Package.dir != "." {
+				rel = strings.TrimPrefix(file, placement.Package.dir+"/")
+			}
+			files = append(files, File{FS: placement.Package.fsys, Path: file, Name: path.Join(placement.Path, rel)})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", placement.Package.Name, err)
+		}
+	}
+	return files, nil
+}
+
+// placement is where a package goes in a flat node_modules
+type placement struct {
+	Package *pkg
+	// Path is the package's directory, eg node_modules/a or node_modules/a/node_modules/b
+	Path string
+}
+
+// hoist lays the dependency graph out as a node_modules tree. Each dependency is resolved by looking up the
+// tree from the package which needs it, the same way node does: if a copy is found it's reused, if a different
+// copy is found the dependency is nested under the package, and otherwise it goes at the top level.
+func hoist(roots []*pkg) []placement {
+	placed := map[string]*pkg{}
+	var placements []placement
+	place := func(parent string, name string, p *pkg) {
+		location := path.Join("node_modules", name)
+		for dir := parent; ; dir = parentDir(dir) {
+			if existing, ok := placed[path.Join(dir, "node_modules", name)]; ok {
+				if existing.id == p.id {
+					return
+				}
+				location = path.Join(parent, "node_modules", name)
+				break
+			}
+			if dir == "" {
+				break
+			}
+		}
+		placed[location] = p
+		placements = append(placements, placement{Package: p, Path: location})
+	}
+	for _, p := range roots {
+		place("", p.Name, p)
+	}
+	// placements grows as dependencies are placed, so this works through them breadth first
+	for ix := 0; ix < len(placements); ix++ {
+		for _, dep := range placements[ix].Package.deps {
+			place(placements[ix].Path, dep.Name, dep)
+		}
+	}
+	sort.SliceStable(placements, func(i, j int) bool {
+		return placements[i].Path < placements[j].Path
+	})
+	return placements
+}
+
+// Returns the directory of the package a nested package sits under, or "" for the top level
+func parentDir(dir string) string {
+	ix := strings.LastIndex(dir, "/node_modules/")
+	if ix < 0 {
+		return ""
+	}
+	return dir[:ix]
+}
+
+// Lists the packages in a node_modules directory, following scopes, as a map of package name to path
+func listNodeModules(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	packages := map[string]string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if strings.HasPrefix(name, "@") {
+			scoped, err := os.ReadDir(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range scoped {
+				packages[name+"/"+s.Name()] = filepath.Join(dir, name, s.Name())
+			}
+			continue
+		}
+		packages[name] = filepath.Join(dir, name)
+	}
+	return packages, nil
+}
+
+// Builds the dependency graph of a pnpm install. The top level node_modules links to the direct dependencies in
+// node_modules/.pnpm/<id>/node_modules/<name>, and each package's own dependencies are linked in alongside it.
+func pnpmPackages(root string) ([]*pkg, error) {
+	byDir := map[string]*pkg{}
+	var load func(name string, link string) (*pkg, error)
+	load = func(name string, link string) (*pkg, error) {
+		realDir, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			return nil, err
+		}
+		key := name + "\x00" + realDir
+		if p, ok := byDir[key]; ok {
+			return p, nil
+		}
+		p := &pkg{Name: name, fsys: os.DirFS(realDir), dir: ".", id: realDir}
+		byDir[key] = p
+
+		// the package's dependencies sit next to it, in the node_modules directory it's in
+		siblings := realDir
+		for range strings.Split(name, "/") {
+			siblings = filepath.Dir(siblings)
+		}
+		if filepath.Base(siblings) != "node_modules" || !strings.Contains(realDir, string(filepath.Separator)+".pnpm"+string(filepath.Separator)) {
+			return p, nil
+		}
+		deps, err := listNodeModules(siblings)
+		if err != nil {
+			return nil, err
+		}
+		for _, depName := range sortedKeys(deps) {
+			if depName == name {
+				continue
+			}
+			dep, err := load(depName, deps[depName])
+			if err != nil {
+				return nil, err
+			}
+			p.deps = append(p.deps, dep)
+		}
+		return p, nil
+	}
+
+	direct, err := listNodeModules(filepath.Join(root, "node_modules"))
+	if err != nil {
+		return nil, err
+	}
+	var roots []*pkg
+	for _, name := range sortedKeys(direct) {
+		p, err := load(name, direct[name])
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, p)
+	}
+	return roots, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The parts of yarn's plug'n'play runtime state used to find packages
+type pnpState struct {
+	PackageRegistryData []pnpRegistryEntry `json:"packageRegistryData"`
+}
+
+// [name, [[reference, info], ...]]
+type pnpRegistryEntry []json.RawMessage
+
+type pnpPackageInformation struct {
+	PackageLocation     string              `json:"packageLocation"`
+	PackageDependencies [][]json.RawMessage `json:"packageDependencies"`
+}
+
+// Reads the plug'n'play runtime state, from .pnp.data.json if yarn was set not to inline it, or else from the
+// RAW_RUNTIME_STATE string in .pnp.cjs
+func readPnpState(root string) (*pnpState, error) {
+	var raw []byte
+	data, err := os.ReadFile(filepath.Join(root, ".pnp.data.json"))
+	if err == nil {
+		raw = data
+	} else {
+		script, err := os.ReadFile(filepath.Join(root, ".pnp.cjs"))
+		if errors.Is(err, fs.ErrNotExist) {
+			script, err = os.ReadFile(filepath.Join(root, ".pnp.js"))
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw, err = inlineState(string(script))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var state pnpState
+	err = json.Unmarshal(raw, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the plug'n'play state: %w", err)
+	}
+	return &state, nil
+}
+
+// Extracts the JSON from the single quoted RAW_RUNTIME_STATE string yarn inlines into .pnp.cjs
+func inlineState(script string) ([]byte, error) {
+	const marker = "RAW_RUNTIME_STATE ="
+	ix := strings.Index(script, marker)
+	if ix < 0 {
+		return nil, errors.New("couldn't find RAW_RUNTIME_STATE in .pnp.cjs")
+	}
+	rest := strings.TrimLeft(script[ix+len(marker):], " \t\r\n")
+	if !strings.HasPrefix(rest, "'") {
+		return nil, errors.New("expected RAW_RUNTIME_STATE to be a string in .pnp.cjs")
+	}
+	var state strings.Builder
+	for i := 1; i < len(rest); i++ {
+		switch rest[i] {
+		case '\\':
+			i++
+			if i < len(rest) && rest[i] != '\n' {
+				state.WriteByte(rest[i])
+			}
+		case '\'':
+			return []byte(state.String()), nil
+		default:
+			state.WriteByte(rest[i])
+		}
+	}
+	return nil, errors.New("unterminated RAW_RUNTIME_STATE in .pnp.cjs")
+}
+
+// A file on disk which is opened for each read and closed straight after, so the archives in the yarn cache don't
+// each hold a file descriptor open until their files have been bundled, which would run out of them in big projects
+type reopeningFile string
+
+func (name reopeningFile) ReadAt(p []byte, off int64) (int, error) {
+	f, err := os.Open(string(name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(p, off)
+}
+
+// Builds the dependency graph of a yarn plug'n'play install. Packages live in zips in .yarn/cache, unless they've
+// been unplugged into .yarn/unplugged, or are workspaces in the project.
+func pnpPackages(root string) ([]*pkg, error) {
+	state, err := readPnpState(root)
+	if err != nil {
+		return nil, err
+	}
+
+	type locator struct{ name, reference string }
+	infos := map[locator]pnpPackageInformation{}
+	var top *pnpPackageInformation
+	for _, entry := range state.PackageRegistryData {
+		if len(entry) != 2 {
+			continue
+		}
+		var name *string
+		var references [][]json.RawMessage
+		if json.Unmarshal(entry[0], &name) != nil || json.Unmarshal(entry[1], &references) != nil {
+			return nil, errors.New("unexpected package registry data in the plug'n'play state")
+		}
+		for _, ref := range references {
+			if len(ref) != 2 {
+				continue
+			}
+			var reference *string
+			var info pnpPackageInformation
+			if json.Unmarshal(ref[0], &reference) != nil || json.Unmarshal(ref[1], &info) != nil {
+				return nil, errors.New("unexpected package information in the plug'n'play state")
+			}
+			if name == nil && reference == nil {
+				top = &info
+				continue
+			}
+			if name != nil && reference != nil {
+				infos[locator{*name, *reference}] = info
+			}
+		}
+	}
+	if top == nil {
+		return nil, errors.New("couldn't find the top level package in the plug'n'play state")
+	}
+
+	zips := map[string]*zip.Reader{}
+	// opens the directory or zip a package location points at
+	locate := func(location string) (fs.FS, string, error) {
+		location = strings.TrimSuffix(location, "/")
+		if ix := strings.Index(location, ".zip/"); ix >= 0 {
+			archive := filepath.Join(root, filepath.FromSlash(location[:ix+4]))
+			r, ok := zips[archive]
+			if !ok {
+				info, err := os.Stat(archive)
+				if err != nil {
+					return nil, "", err
+				}
+				r, err = zip.NewReader(reopeningFile(archive), info.Size())
+				if err != nil {
+					return nil, "", fmt.Errorf("failed to read %s: %w", archive, err)
+				}
+				zips[archive] = r
+			}
+			return r, location[ix+5:], nil
+		}
+		return os.DirFS(filepath.Join(root, filepath.FromSlash(location))), ".", nil
+	}
+
+	packages := map[string]*pkg{}
+	var load func(name string, loc locator) (*pkg, error)
+	// resolves a dependency tuple, [name, reference] where the reference may be an alias [actualName, reference]
+	resolve := func(dep []json.RawMessage) (string, *locator, error) {
+		if len(dep) != 2 {
+			return "", nil, errors.New("unexpected dependency in the plug'n'play state")
+		}
+		var name string
+		if err := json.Unmarshal(dep[0], &name); err != nil {
+			return "", nil, err
+		}
+		var reference *string
+		if json.Unmarshal(dep[1], &reference) == nil {
+			if reference == nil {
+				// a missing optional peer dependency
+				return name, nil, nil
+			}
+			return name, &locator{name, *reference}, nil
+		}
+		var alias []string
+		if err := json.Unmarshal(dep[1], &alias); err != nil || len(alias) != 2 {
+			return "", nil, errors.New("unexpected dependency reference in the plug'n'play state")
+		}
+		return name, &locator{alias[0], alias[1]}, nil
+	}
+	load = func(name string, loc locator) (*pkg, error) {
+		key := name + "\x00" + loc.name + "\x00" + loc.reference
+		if p, ok := packages[key]; ok {
+			return p, nil
+		}
+		info, ok := infos[loc]
+		if !ok {
+			return nil, fmt.Errorf("couldn't find %s@%s in the plug'n'play state", loc.name, loc.reference)
+		}
+		fsys, dir, err := locate(info.PackageLocation)
+		if err != nil {
+			return nil, err
+		}
+		p := &pkg{Name: name, fsys: fsys, dir: dir, id: loc.name + "@" + loc.reference}
+		packages[key] = p
+		for _, dep := range info.PackageDependencies {
+			depName, depLoc, err := resolve(dep)
+			if err != nil {
+				return nil, err
+			}
+			if depLoc == nil || *depLoc == loc || infos[*depLoc].PackageLocation == "./" {
+				continue
+			}
+			d, err := load(depName, *depLoc)
+			if err != nil {
+				return nil, err
+			}
+			p.deps = append(p.deps, d)
+		}
+		return p, nil
+	}
+
+	var roots []*pkg
+	for _, dep := range top.PackageDependencies {
+		name, loc, err := resolve(dep)
+		if err != nil {
+			return nil, err
+		}
+		// the project depends on itself as a workspace, which isn't a dependency to bundle
+		if loc == nil || infos[*loc].PackageLocation == "./" {
+			continue
+		}
+		p, err := load(name, *loc)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, p)
+	}
+	sort.SliceStable(roots, func(i, j int) bool {
+		return roots[i].Name < roots[j].Name
+	})
+	return roots, nil
+}
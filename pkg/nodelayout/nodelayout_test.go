@@ -0,0 +1,233 @@
+package nodelayout
+
+import (
+	"archive/zip"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, name string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal("Error creating directory", err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal("Error writing file", err)
+	}
+}
+
+func link(t *testing.T, target string, name string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal("Error creating directory", err)
+	}
+	if err := os.Symlink(target, name); err != nil {
+		t.Fatal("Error creating symlink", err)
+	}
+}
+
+func readAll(t *testing.T, files []File) map[string]string {
+	t.Helper()
+	contents := map[string]string{}
+	for _, f := range files {
+		content, err := fs.ReadFile(f.FS, f.Path)
+		if err != nil {
+			t.Fatal("Error reading", f.Name, err)
+		}
+		contents[f.Name] = string(content)
+	}
+	return contents
+}
+
+func expectFiles(t *testing.T, files []File, expected []string, contents map[string]string) {
+	t.Helper()
+	if len(files) != len(expected) {
+		t.Fatalf("Expected %d files, got %v", len(expected), files)
+	}
+	for ix, f := range files {
+		if f.Name != expected[ix] {
+			t.Fatalf("Expected %s at %d, got %s", expected[ix], ix, f.Name)
+		}
+	}
+	actual := readAll(t, files)
+	for name, content := range contents {
+		if actual[name] != content {
+			t.Fatalf("Expected %s to contain %q, got %q", name, content, actual[name])
+		}
+	}
+}
+
+// Builds a pnpm install where a and c depend on b@2, but the project depends on b@1 directly
+func writePnpmTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	store := filepath.Join(dir, "node_modules", ".pnpm")
+	writeFile(t, filepath.Join(store, "a@1.0.0", "node_modules", "a", "index.js"), "a")
+	link(t, "../../b@2.0.0/node_modules/b", filepath.Join(store, "a@1.0.0", "node_modules", "b"))
+	writeFile(t, filepath.Join(store, "b@1.0.0", "node_modules", "b", "index.js"), "b1")
+	writeFile(t, filepath.Join(store, "b@2.0.0", "node_modules", "b", "index.js"), "b2")
+	writeFile(t, filepath.Join(store, "c@1.0.0", "node_modules", "c", "index.js"), "c")
+	link(t, "../../b@2.0.0/node_modules/b", filepath.Join(store, "c@1.0.0", "node_modules", "b"))
+	writeFile(t, filepath.Join(store, "@s+d@1.0.0", "node_modules", "@s", "d", "index.js"), "d")
+	link(t, ".pnpm/a@1.0.0/node_modules/a", filepath.Join(dir, "node_modules", "a"))
+	link(t, ".pnpm/b@1.0.0/node_modules/b", filepath.Join(dir, "node_modules", "b"))
+	link(t, ".pnpm/c@1.0.0/node_modules/c", filepath.Join(dir, "node_modules", "c"))
+	link(t, "../.pnpm/@s+d@1.0.0/node_modules/@s/d", filepath.Join(dir, "node_modules", "@s", "d"))
+	writeFile(t, filepath.Join(dir, "node_modules", ".modules.yaml"), "layoutVersion: 5")
+	return dir
+}
+
+func TestDetect(t *testing.T) {
+	if layout := Detect(writePnpmTree(t)); layout != PNPM {
+		t.Fatal("Expected pnpm, got", layout)
+	}
+	npm := t.TempDir()
+	writeFile(t, filepath.Join(npm, "node_modules", "a", "index.js"), "a")
+	if layout := Detect(npm); layout != NPM {
+		t.Fatal("Expected npm, got", layout)
+	}
+	pnp := t.TempDir()
+	writeFile(t, filepath.Join(pnp, ".pnp.cjs"), "")
+	if layout := Detect(pnp); layout != PnP {
+		t.Fatal("Expected pnp, got", layout)
+	}
+	if layout := Detect(t.TempDir()); layout != NPM {
+		t.Fatal("Expected npm with nothing installed, got", layout)
+	}
+}
+
+func TestMaterializePnpm(t *testing.T) {
+	files, err := Materialize(writePnpmTree(t), PNPM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFiles(t, files, []string{
+		"node_modules/@s/d/index.js",
+		"node_modules/a/index.js",
+		"node_modules/a/node_modules/b/index.js",
+		"node_modules/b/index.js",
+		"node_modules/c/index.js",
+		"node_modules/c/node_modules/b/index.js",
+	}, map[string]string{
+		"node_modules/a/node_modules/b/index.js": "b2",
+		"node_modules/b/index.js":                "b1",
+	})
+}
+
+func TestHoist(t *testing.T) {
+	b := &pkg{Name: "b", id: "b@1"}
+	c1 := &pkg{Name: "c", id: "c@1"}
+	c2 := &pkg{Name: "c", id: "c@2", deps: []*pkg{b}}
+	a := &pkg{Name: "a", id: "a@1", deps: []*pkg{b, c2}}
+	var placed []string
+	for _, p := range hoist([]*pkg{a, c1}) {
+		placed = append(placed, p.Path+" "+p.Package.id)
+	}
+	expected := []string{
+		"node_modules/a a@1",
+		"node_modules/a/node_modules/c c@2",
+		"node_modules/b b@1",
+		"node_modules/c c@1",
+	}
+	if len(placed) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, placed)
+	}
+	for ix := range expected {
+		if placed[ix] != expected[ix] {
+			t.Fatalf("Expected %v, got %v", expected, placed)
+		}
+	}
+}
+
+const testPnpState = `{"packageRegistryData": [
+  [null, [[null, {"packageLocation": "./", "packageDependencies": [["a", "npm:1.0.0"], ["app", "workspace:."]], "linkType": "SOFT"}]]],
+  ["a", [["npm:1.0.0", {"packageLocation": "./.yarn/cache/a-npm-1.0.0-123.zip/node_modules/a/", "packageDependencies": [["a", "npm:1.0.0"], ["b", ["c", "npm:1.0.0"]], ["peer", null]], "linkType": "HARD"}]]],
+  ["app", [["workspace:.", {"packageLocation": "./", "packageDependencies": [["a", "npm:1.0.0"]], "linkType": "SOFT"}]]],
+  ["c", [["npm:1.0.0", {"packageLocation": "./.yarn/unplugged/c-npm-1.0.0/node_modules/c/", "packageDependencies": [["c", "npm:1.0.0"]], "linkType": "HARD"}]]]
+]}`
+
+func writePnpTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, ".yarn", "unplugged", "c-npm-1.0.0", "node_modules", "c", "index.js"), "c")
+	archive := filepath.Join(dir, ".yarn", "cache", "a-npm-1.0.0-123.zip")
+	if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		t.Fatal("Error creating directory", err)
+	}
+	out, err := os.Create(archive)
+	if err != nil {
+		t.Fatal("Error creating zip", err)
+	}
+	w := zip.NewWriter(out)
+	for name, content := range map[string]string{
+		"node_modules/a/index.js":     "a",
+		"node_modules/a/package.json": "{}",
+	} {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+	out.Close()
+	return dir
+}
+
+func TestMaterializePnp(t *testing.T) {
+	dir := writePnpTree(t)
+	writeFile(t, filepath.Join(dir, ".pnp.data.json"), testPnpState)
+	files, err := Materialize(dir, PnP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFiles(t, files, []string{
+		"node_modules/a/index.js",
+		"node_modules/a/package.json",
+		"node_modules/b/index.js",
+	}, map[string]string{
+		"node_modules/a/index.js": "a",
+		"node_modules/b/index.js": "c",
+	})
+}
+
+func TestMaterializePnpClosesArchives(t *testing.T) {
+	openFiles := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("Can't count open files on this platform")
+		}
+		return len(entries)
+	}
+	dir := writePnpTree(t)
+	writeFile(t, filepath.Join(dir, ".pnp.data.json"), testPnpState)
+	before := openFiles()
+	files, err := Materialize(dir, PnP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, files)
+	if after := openFiles(); after != before {
+		t.Fatalf("Expected the yarn cache zips to be closed, %d files were open before and %d after", before, after)
+	}
+}
+
+func TestMaterializePnpInlineState(t *testing.T) {
+	dir := writePnpTree(t)
+	script := "#!/usr/bin/env node\n/* eslint-disable */\n\"use strict\";\n\nconst RAW_RUNTIME_STATE =\n'" +
+		"{\"__info\": [\"it\\'s generated\"],\\\n\"packageRegistryData\": " + testPnpState[len(`{"packageRegistryData": `):] +
+		"';\n\nfunction $$SETUP_STATE(hydrateRuntimeState, basePath) {}\n"
+	writeFile(t, filepath.Join(dir, ".pnp.cjs"), script)
+	files, err := Materialize(dir, PnP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 files, got %v", files)
+	}
+}
+
+func TestMaterializeNpm(t *testing.T) {
+	if _, err := Materialize(t.TempDir(), NPM); err == nil {
+		t.Fatal("Expected an error materializing an npm layout")
+	}
+}
@@ -0,0 +1,160 @@
+package preset
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Layer describes how a runtime expects its dependencies to be laid out in a lambda layer
+type Layer struct {
+	// Source is the directory within the input path that holds the dependencies
+	Source string
+	// Include is an array of globs, relative to Source, defining what goes into the layer
+	Include []string
+	// Exclude is an array of globs, relative to Source, defining what to leave out of the layer
+	Exclude []string
+	// Root is the directory within the layer zip the dependencies are saved to
+	Root string
+	// VersionedRoot is used instead of Root when a runtime version is known, %s is replaced with the version
+	VersionedRoot string
+}
+
+// RootDir returns the directory within the layer zip to save the dependencies to for a runtime version
+func (l Layer) RootDir(version string) string {
+	if version != "" && l.VersionedRoot != "" {
+		return fmt.Sprintf(l.VersionedRoot, version)
+	}
+	return l.Root
+}
+
+// Preset is a curated set of packaging rules for a runtime
+type Preset struct {
+	Name    string
+	Include []string
+	Exclude []string
+	Layer   *Layer
+}
+
+var commonExclude = []string{".git/**", "**/.DS_Store", ".env", ".env.*"}
+
+var presets = map[string]Preset{
+	"node": {
+		Name:    "node",
+		Include: []string{"**"},
+		Exclude: append([]string{
+			"**/*.test.js",
+			"**/*.spec.js",
+			"**/__tests__/**",
+			"**/*.map",
+			"**/*.md",
+			"**/*.ts",
+			"coverage/**",
+			".nyc_output/**",
+		}, commonExclude...),
+		Layer: &Layer{
+			Source:        "",
+			Include:       []string{"node_modules/**"},
+			Root:          "nodejs",
+			VersionedRoot: "nodejs/node%s",
+		},
+	},
+	"python": {
+		Name:    "python",
+		Include: []string{"**"},
+		Exclude: append([]string{
+			"**/__pycache__/**",
+			"**/*.pyc",
+			"**/tests/**",
+			"**/test_*.py",
+			".venv/**",
+			"venv/**",
+			".pytest_cache/**",
+			".mypy_cache/**",
+			"**/*.md",
+		}, commonExclude...),
+		Layer: &Layer{
+			Source:        "package",
+			Include:       []string{"**"},
+			Exclude:       []string{"**/__pycache__/**", "**/*.pyc"},
+			Root:          "python",
+			VersionedRoot: "python/lib/python%s/site-packages",
+		},
+	},
+	"go": {
+		Name:    "go",
+		Include: []string{},
+		Exclude: append([]string{
+			"**/*.go",
+			"go.mod",
+			"go.sum",
+			"vendor/**",
+		}, commonExclude...),
+	},
+	"java": {
+		Name:    "java",
+		Include: []string{"**/*.class", "**/*.properties", "**/*.xml", "lib/**"},
+		Exclude: append([]string{
+			"src/**",
+			"target/**",
+			"build/**",
+			"**/*.java",
+			"**/*.md",
+		}, commonExclude...),
+		Layer: &Layer{
+			Source:  "",
+			Include: []string{"lib/**"},
+			Root:    "java",
+		},
+	},
+	"ruby": {
+		Name:    "ruby",
+		Include: []string{"**"},
+		Exclude: append([]string{
+			"spec/**",
+			"test/**",
+			".bundle/**",
+			"**/*.md",
+		}, commonExclude...),
+		Layer: &Layer{
+			Source:  "vendor/bundle/ruby",
+			Include: []string{"**"},
+			Exclude: []string{"*/cache/**"},
+			Root:    "ruby/gems",
+		},
+	},
+}
+
+// Names returns the names of the available presets
+func Names() []string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the preset with the given name
+func Get(name string) (Preset, error) {
+	preset, ok := presets[name]
+	if !ok {
+		return Preset{}, fmt.Errorf("unknown preset '%s', expected one of %s", name, strings.Join(Names(), ", "))
+	}
+	return preset, nil
+}
+
+// Resolve combines the preset's rules with user supplied ones. User includes replace the preset's includes when
+// given, and user excludes are added to the preset's excludes unless override is set, in which case they replace
+// them.
+func (p Preset) Resolve(include []string, exclude []string, override bool) ([]string, []string) {
+	resolvedInclude := p.Include
+	if include != nil {
+		resolvedInclude = include
+	}
+	if override {
+		return resolvedInclude, exclude
+	}
+	resolvedExclude := append(append([]string{}, p.Exclude...), exclude...)
+	return resolvedInclude, resolvedExclude
+}
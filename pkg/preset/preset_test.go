@@ -0,0 +1,71 @@
+package preset
+
+import (
+	"testing"
+)
+
+func TestGetUnknownPreset(t *testing.T) {
+	_, err := Get("cobol")
+	if err == nil {
+		t.Fatal("Expected an error for an unknown preset")
+	}
+}
+
+func TestNames(t *testing.T) {
+	names := Names()
+	if len(names) != 5 || names[0] != "go" || names[4] != "ruby" {
+		t.Fatal("names", names)
+	}
+}
+
+func TestResolveDefaults(t *testing.T) {
+	p, err := Get("node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	include, exclude := p.Resolve(nil, []string{}, false)
+	if len(include) != 1 || include[0] != "**" {
+		t.Fatal("include", include)
+	}
+	if len(exclude) != len(p.Exclude) {
+		t.Fatal("exclude", exclude)
+	}
+}
+
+func TestResolveExtendsExcludes(t *testing.T) {
+	p, err := Get("node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	include, exclude := p.Resolve([]string{"dist/**"}, []string{"**/*.snap"}, false)
+	if len(include) != 1 || include[0] != "dist/**" {
+		t.Fatal("include", include)
+	}
+	if len(exclude) != len(p.Exclude)+1 || exclude[len(exclude)-1] != "**/*.snap" {
+		t.Fatal("exclude", exclude)
+	}
+}
+
+func TestResolveOverridesExcludes(t *testing.T) {
+	p, err := Get("node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, exclude := p.Resolve(nil, []string{"**/*.snap"}, true)
+	if len(exclude) != 1 || exclude[0] != "**/*.snap" {
+		t.Fatal("exclude", exclude)
+	}
+}
+
+func TestLayerRootDir(t *testing.T) {
+	p, err := Get("python")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := p.Layer.RootDir(""); root != "python" {
+		t.Fatal("root", root)
+	}
+	if root := p.Layer.RootDir("3.12"); root != "python/lib/python3.12/site-packages" {
+		t.Fatal("root", root)
+	}
+}
@@ -0,0 +1,61 @@
+package retention
+
+import (
+	"sort"
+	"time"
+)
+
+// Object describes an artifact stored in a bucket
+type Object struct {
+	Key          string    `json:"key"`
+	LastModified time.Time `json:"lastModified"`
+	Size         int64     `json:"size"`
+}
+
+// Policy describes which objects should survive a prune. An object is kept if it matches any of the rules.
+type Policy struct {
+	// KeepLatest keeps the newest N objects
+	KeepLatest int
+	// KeepWithin keeps objects modified within this duration of Now
+	KeepWithin time.Duration
+	// KeepKeys keeps objects with these exact keys, eg the keys of currently deployed versions
+	KeepKeys []string
+	// Now is the time KeepWithin is measured from
+	Now time.Time
+}
+
+// IsEmpty reports whether the policy has no rules, in which case applying it would delete everything
+func (p Policy) IsEmpty() bool {
+	return p.KeepLatest <= 0 && p.KeepWithin <= 0 && len(p.KeepKeys) == 0
+}
+
+// Apply splits a set of objects into those the policy keeps and those which should be deleted. Both
+// lists are sorted newest first. An empty policy keeps everything.
+func Apply(objects []Object, policy Policy) (keep []Object, remove []Object) {
+	sorted := make([]Object, len(objects))
+	copy(sorted, objects)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LastModified.After(sorted[j].LastModified)
+	})
+	if policy.IsEmpty() {
+		return sorted, nil
+	}
+
+	keepKeys := make(map[string]bool, len(policy.KeepKeys))
+	for _, key := range policy.KeepKeys {
+		keepKeys[key] = true
+	}
+	for ix, object := range sorted {
+		switch {
+		case ix < policy.KeepLatest:
+			keep = append(keep, object)
+		case policy.KeepWithin > 0 && policy.Now.Sub(object.LastModified) <= policy.KeepWithin:
+			keep = append(keep, object)
+		case keepKeys[object.Key]:
+			keep = append(keep, object)
+		default:
+			remove = append(remove, object)
+		}
+	}
+	return keep, remove
+}
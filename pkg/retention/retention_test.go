@@ -0,0 +1,62 @@
+package retention
+
+import (
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func testObjects() []Object {
+	return []Object{
+		{Key: "fn-1.zip", LastModified: now.Add(-96 * time.Hour)},
+		{Key: "fn-3.zip", LastModified: now.Add(-24 * time.Hour)},
+		{Key: "fn-2.zip", LastModified: now.Add(-48 * time.Hour)},
+		{Key: "fn-4.zip", LastModified: now.Add(-1 * time.Hour)},
+	}
+}
+
+func keys(objects []Object) []string {
+	var result []string
+	for _, object := range objects {
+		result = append(result, object.Key)
+	}
+	return result
+}
+
+func TestEmptyPolicyKeepsEverything(t *testing.T) {
+	keep, remove := Apply(testObjects(), Policy{})
+	if len(keep) != 4 || len(remove) != 0 {
+		t.Fatal("length", len(keep), len(remove))
+	}
+}
+
+func TestKeepLatest(t *testing.T) {
+	keep, remove := Apply(testObjects(), Policy{KeepLatest: 2})
+	if len(keep) != 2 || keep[0].Key != "fn-4.zip" || keep[1].Key != "fn-3.zip" {
+		t.Fatal("keep", keys(keep))
+	}
+	if len(remove) != 2 || remove[0].Key != "fn-2.zip" || remove[1].Key != "fn-1.zip" {
+		t.Fatal("remove", keys(remove))
+	}
+}
+
+func TestKeepWithin(t *testing.T) {
+	keep, remove := Apply(testObjects(), Policy{KeepWithin: 48 * time.Hour, Now: now})
+	if len(keep) != 3 {
+		t.Fatal("keep", keys(keep))
+	}
+	if len(remove) != 1 || remove[0].Key != "fn-1.zip" {
+		t.Fatal("remove", keys(remove))
+	}
+}
+
+func TestKeepKeys(t *testing.T) {
+	keep, remove := Apply(testObjects(), Policy{KeepLatest: 1, KeepKeys: []string{"fn-1.zip"}})
+	if len(keep) != 2 || keep[0].Key != "fn-4.zip" || keep[1].Key != "fn-1.zip" {
+		t.Fatal("keep", keys(keep))
+	}
+	if len(remove) != 2 {
+		t.Fatal("remove", keys(remove))
+	}
+}
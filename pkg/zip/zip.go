@@ -3,18 +3,195 @@ package zip
 import (
 	"archive/zip"
 	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/bbeesley/fn-push/pkg/ignore"
 	"github.com/bmatcuk/doublestar/v4"
 )
 
+// Entry describes a file from outside the matched file list which should be added to the archive, optionally
+// under a different name or with a fixed mode
+type Entry struct {
+	// Source is the path of the file on disk, or within FS when it's set
+	Source string
+	// FS optionally holds the file, eg when it comes from inside another zip rather than the filesystem
+	FS fs.FS
+	// Name is the path of the file within the archive, relative to the rootDir
+	Name string
+	// Mode overrides the file's mode in the archive when set, regardless of the host filesystem
+	Mode fs.FileMode
+	// AtRoot puts the entry at Name from the root of the archive instead of under the rootDir, eg for a Lambda
+	// extension's executable, which has to be in extensions/ whatever the rest of the layer is under
+	AtRoot bool
+}
+
+// Returns the path of the entry within the archive
+func (e Entry) archiveName(rootDir string) string {
+	if e.AtRoot {
+		return filepath.ToSlash(e.Name)
+	}
+	return filepath.ToSlash(filepath.Join(rootDir, e.Name))
+}
+
+// Link is a symlink to add to an archive
+type Link struct {
+	// Name is the path of the link within the archive. Unlike files and entries, it isn't put under the rootDir.
+	Name string
+	// Target is where the link points, eg /opt/nodejs/node_modules
+	Target string
+}
+
+// SymlinkPolicy decides what happens to symlinks in the tree being archived
+type SymlinkPolicy string
+
+const (
+	// FollowSymlinks adds what symlinks point at as though it was in the tree. Links to a directory which is
+	// already being walked are skipped, so cycles don't recurse forever.
+	FollowSymlinks SymlinkPolicy = "follow"
+	// PreserveSymlinks adds symlinks to the archive as symlinks, so pnpm style node_modules aren't duplicated
+	PreserveSymlinks SymlinkPolicy = "preserve"
+	// ErrorOnSymlinks fails the build if the tree has any symlinks in it
+	ErrorOnSymlinks SymlinkPolicy = "error"
+)
+
+// Options configures how an archive is built
+type Options struct {
+	// Include is an array of globs defining which files under the base path to add
+	Include []string
+	// Exclude is an array of globs defining which of the included files to leave out
+	Exclude []string
+	// RootDir is an optional path within the archive to save the files to
+	RootDir string
+	// SymlinkNodeModules adds a node_modules symlink pointing at SymlinkTarget in the /opt directory. Links gives
+	// control over the name and target.
+	SymlinkNodeModules bool
+	SymlinkTarget      string
+	// Links are symlinks to add to the archive, eg node_modules pointing at a layer's node_modules in /opt
+	Links []Link
+	// Entries are added to the archive alongside the files matched by Include
+	Entries []Entry
+	// IgnoreFiles are the names of gitignore style files, eg .gitignore, whose patterns exclude files from the
+	// archive. Nested ignore files apply to their own directories, and the ignore files themselves are left out.
+	IgnoreFiles []string
+	// IgnoreExempt is an array of globs matching files the ignore files don't apply to, eg node_modules/**, which
+	// is usually in .gitignore but needed at runtime
+	IgnoreExempt []string
+	// Filter, when set, is called with each matched file and its size, and leaves it out of the archive if it
+	// returns false
+	Filter func(file string, size int64) bool
+	// Workers is how many files are read and compressed at once, defaulting to the number of CPUs
+	Workers int
+	// CompressionLevel is the deflate level from 1 (fastest) to 9 (smallest), or NoCompression to store every file
+	// as it is. The zero value uses the default level of 5.
+	CompressionLevel int
+	// Compressor is the name of a registered compressor to deflate files with, defaulting to "deflate"
+	Compressor string
+	// Store is an array of globs matching files which are already compressed, eg *.png, and should be stored in
+	// the archive as they are
+	Store []string
+	// Symlinks is what to do with symlinks in the tree, following them by default. Links which point outside of
+	// the base path are an error unless AllowExternalSymlinks is set, and always when preserving them.
+	Symlinks              SymlinkPolicy
+	AllowExternalSymlinks bool
+	// Cache, when set, is checked for an archive built from the same files and options before compressing
+	// anything, and stores the archive if there isn't one
+	Cache Cache
+	// Log is where progress messages, eg which files were left out, are written, defaulting to os.Stdout. Set it to
+	// io.Discard to silence them.
+	Log io.Writer
+}
+
+// LogWriter returns the writer progress messages go to
+func (opts Options) LogWriter() io.Writer {
+	if opts.Log == nil {
+		return os.Stdout
+	}
+	return opts.Log
+}
+
+// Cache stores built archives by a key which changes whenever the archive's inputs do
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Put(key string, data []byte) error
+}
+
+// The version of the archive layout, which is part of every cache key so archives built by older versions of
+// fn-push aren't reused
+const cacheVersion = "1"
+
+// cacheKey fingerprints everything which goes into an archive: the options which change its contents, and the
+// name, size, mode and modified time of every file
+func cacheKey(path string, files []string, opts Options) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "version %s\n", cacheVersion)
+	fmt.Fprintf(h, "rootDir %q\n", opts.RootDir)
+	fmt.Fprintf(h, "symlink %v %q\n", opts.SymlinkNodeModules, opts.SymlinkTarget)
+	for _, link := range opts.Links {
+		fmt.Fprintf(h, "link %q %q\n", link.Name, link.Target)
+	}
+	fmt.Fprintf(h, "compression %d %q %q\n", opts.CompressionLevel, opts.Compressor, opts.Store)
+	fmt.Fprintf(h, "symlinks %q %v\n", opts.Symlinks, opts.AllowExternalSymlinks)
+	fingerprint := func(kind string, name string, source string, mode fs.FileMode) error {
+		info, err := os.Stat(source)
+		if err != nil {
+			return err
+		}
+		var link string
+		if opts.Symlinks == PreserveSymlinks {
+			link, _ = os.Readlink(source)
+		}
+		fmt.Fprintf(h, "%s %q %d %v %d %v %q\n", kind, name, info.Size(), info.Mode(), info.ModTime().UnixNano(), mode, link)
+		return nil
+	}
+	fullPath := getFullPath(path)
+	for _, file := range files {
+		if err := fingerprint("file", file, filepath.Join(fullPath, file), 0); err != nil {
+			return "", err
+		}
+	}
+	for _, entry := range opts.Entries {
+		if entry.FS != nil {
+			// there's nothing on disk to stat, so fingerprint the contents instead
+			content, err := fs.ReadFile(entry.FS, entry.Source)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "fs entry %q %x %v\n", entry.archiveName(opts.RootDir), sha256.Sum256(content), entry.Mode)
+			continue
+		}
+		source, err := filepath.Abs(entry.Source)
+		if err != nil {
+			return "", err
+		}
+		if err := fingerprint("entry", entry.archiveName(opts.RootDir), source, entry.Mode); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func getFullPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
 	f, getWdErr := os.Getwd()
 	if getWdErr != nil {
 		log.Fatal(getWdErr)
@@ -34,18 +211,53 @@ func getFsys(path string) fs.FS {
 	return fsys
 }
 
-func sliceIndex(limit int, predicate func(i int) bool) int {
-	for i := 0; i < limit; i++ {
-		if predicate(i) {
-			return i
+// Reports whether a file's name is one of the ignore files
+func isIgnoreFile(file string, ignoreFiles []string) bool {
+	name := file[strings.LastIndex(file, "/")+1:]
+	for _, ignoreFile := range ignoreFiles {
+		if name == ignoreFile {
+			return true
 		}
 	}
-	return -1
+	return false
 }
 
-func remove(s []string, i int) []string {
-	s[i] = s[len(s)-1]
-	return s[:len(s)-1]
+// Reports whether the ignore files apply to a file
+func ignorable(file string, exempt []string) bool {
+	for _, pattern := range exempt {
+		if match, _ := doublestar.Match(pattern, file); match {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether the ignore files apply to everything under a directory, so it can be skipped when it's ignored
+func ignorableDir(dir string, exempt []string) bool {
+	for _, pattern := range exempt {
+		if match, _ := doublestar.Match(pattern, dir); match || couldMatchUnder(pattern, dir) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterFiles removes the files under fullPath the filter rejects
+func filterFiles(fullPath string, files []string, filter func(file string, size int64) bool, out io.Writer) []string {
+	var results []string
+	for _, file := range files {
+		var size int64
+		if info, err := os.Stat(filepath.Join(fullPath, file)); err == nil {
+			size = info.Size()
+		}
+		if filter(file, size) {
+			results = append(results, file)
+		}
+	}
+	if removed := len(files) - len(results); removed > 0 {
+		fmt.Fprintf(out, "Filtered out %d files\n", removed)
+	}
+	return results
 }
 
 func addSymlinkToZip(zipWriter *zip.Writer, linkPath string, targetPath string) error {
@@ -68,79 +280,668 @@ func addSymlinkToZip(zipWriter *zip.Writer, linkPath string, targetPath string)
 	return nil
 }
 
+// Rule is a single glob in an ordered list of include and exclude globs
+type Rule struct {
+	Pattern string
+	Include bool
+}
+
+// BuildRules turns arrays of include and exclude globs into an ordered list of rules. The includes are evaluated
+// before the excludes, and prefixing a glob with ! inverts it, so "!**/*.md" in the includes leaves markdown files
+// out, and "!node_modules/foo/test/fixtures.json" in the excludes brings back a file an earlier exclude removed.
+func BuildRules(include []string, exclude []string) []Rule {
+	var rules []Rule
+	for _, pattern := range include {
+		negated := strings.HasPrefix(pattern, "!")
+		rules = append(rules, Rule{Pattern: strings.TrimPrefix(pattern, "!"), Include: !negated})
+	}
+	for _, pattern := range exclude {
+		negated := strings.HasPrefix(pattern, "!")
+		rules = append(rules, Rule{Pattern: strings.TrimPrefix(pattern, "!"), Include: negated})
+	}
+	return rules
+}
+
+// matchRules reports whether the last rule matching a file includes it, and whether any include rule matched it,
+// writing any errors in the rules to out
+func matchRules(rules []Rule, file string, out io.Writer) (included bool, matchedInclude bool) {
+	for _, rule := range rules {
+		match, matchError := doublestar.Match(rule.Pattern, file)
+		if matchError != nil {
+			fmt.Fprintf(out, "Error while checking file against rules: %v\n", matchError)
+		}
+		if match {
+			included = rule.Include
+			matchedInclude = matchedInclude || rule.Include
+		}
+	}
+	return included, matchedInclude
+}
+
+// literalPrefix returns the part of a glob before the directory containing its first wildcard, eg "src/" for
+// "src/**/*.js", or the whole glob if it has no wildcards
+func literalPrefix(pattern string) string {
+	meta := strings.IndexAny(pattern, "*?[{\\")
+	if meta < 0 {
+		return pattern
+	}
+	return pattern[:strings.LastIndex(pattern[:meta], "/")+1]
+}
+
+// couldMatchUnder reports whether a glob might match a file somewhere under dir
+func couldMatchUnder(pattern string, dir string) bool {
+	// without a ** the glob only matches files at a fixed depth, which may be shallower than anything under dir
+	if !strings.Contains(pattern, "**") && strings.Count(pattern, "/") <= strings.Count(dir, "/") {
+		return false
+	}
+	prefix := literalPrefix(pattern)
+	dir += "/"
+	return strings.HasPrefix(prefix, dir) || strings.HasPrefix(dir, prefix)
+}
+
+// coversDir reports whether a glob matches everything under dir, eg "node_modules/**" for "node_modules/a" or
+// "**/test/**" for "src/test"
+func coversDir(pattern string, dir string) bool {
+	if pattern == "**" {
+		return true
+	}
+	base, ok := strings.CutSuffix(pattern, "/**")
+	if !ok {
+		return false
+	}
+	for ancestor := dir; ; {
+		if match, _ := doublestar.Match(base, ancestor); match {
+			return true
+		}
+		slash := strings.LastIndex(ancestor, "/")
+		if slash < 0 {
+			return false
+		}
+		ancestor = ancestor[:slash]
+	}
+}
+
+// skipDir reports whether nothing under dir can be included, so the walk doesn't need to descend into it. That's
+// the case when no include rule could match under it after the last rule which excludes all of it.
+func skipDir(rules []Rule, dir string) bool {
+	start := 0
+	for ix := len(rules) - 1; ix >= 0; ix-- {
+		if coversDir(rules[ix].Pattern, dir) {
+			if rules[ix].Include {
+				return false
+			}
+			start = ix + 1
+			break
+		}
+	}
+	for _, rule := range rules[start:] {
+		if rule.Include && couldMatchUnder(rule.Pattern, dir) {
+			return false
+		}
+	}
+	return true
+}
+
+// couldBeIncluded reports whether any include rule could match under dir, ignoring the excludes
+func couldBeIncluded(rules []Rule, dir string) bool {
+	for _, rule := range rules {
+		if rule.Include && couldMatchUnder(rule.Pattern, dir) {
+			return true
+		}
+	}
+	return false
+}
+
 // BuildFileList uses a base path along with arrays on include and exclude globs
-// to build a list of files which must be added to the archive
+// to build a list of files which must be added to the archive. The globs are
+// evaluated in order as described by BuildRules, with the last match winning.
+// The tree is walked once, in lexical order, skipping directories nothing can
+// be included from, and symlinks are followed as long as they stay inside the
+// base path.
 func BuildFileList(path string, include []string, exclude []string) []string {
-	var matches []string
+	files, err := buildFileList(path, Options{Include: include, Exclude: exclude})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return files
+}
+
+// isWithin reports whether path is root or somewhere under it
+func isWithin(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// linkTarget returns where a symlink points, lexically resolved against the link's directory
+func linkTarget(link string) (string, error) {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(link), target)
+	}
+	return filepath.Clean(target), nil
+}
+
+// Walks the tree under path once, applying the include and exclude rules and the symlink policy from the options
+func buildFileList(path string, opts Options) ([]string, error) {
 	var results []string
-	fsys := getFsys(path)
-	for i := 0; i < len(include); i++ {
-		fileSet, error := doublestar.Glob(fsys, include[i], doublestar.WithFilesOnly())
-		if error != nil {
-			fmt.Printf("Failed to get files for glob: %v\n", include[i])
-		}
-		matches = append(matches, fileSet...)
-	}
-	results = append(results, matches...)
-	for i := 0; i < len(exclude); i++ {
-		for j := range matches {
-			exclude, matchError := doublestar.Match(exclude[i], matches[j])
-			if matchError != nil {
-				fmt.Printf("Error while checking file against excludes: %v\n", matchError)
-			}
-			if exclude {
-				index := sliceIndex(len(results), func(ix int) bool { return results[ix] == matches[j] })
-				if index != -1 {
-					fmt.Printf("Removing: %v\n", matches[j])
-					results = remove(results, index)
+	out := opts.LogWriter()
+	rules := BuildRules(opts.Include, opts.Exclude)
+	root, err := filepath.EvalSymlinks(getFullPath(path))
+	if err != nil {
+		return nil, err
+	}
+	policy := opts.Symlinks
+	if policy == "" {
+		policy = FollowSymlinks
+	}
+	if policy != FollowSymlinks && policy != PreserveSymlinks && policy != ErrorOnSymlinks {
+		return nil, fmt.Errorf("unknown symlink policy '%s', expected one of follow, preserve or error", policy)
+	}
+	// the real paths of the directories being walked, so links back up the tree aren't followed round in circles
+	walking := map[string]bool{}
+	// the ignore files are read as their directories are walked, so they're found through symlinks too
+	var ignored *ignore.Matcher
+	if len(opts.IgnoreFiles) > 0 {
+		ignored = &ignore.Matcher{}
+	}
+	fsys := os.DirFS(root)
+
+	// decides whether a symlink is a directory to descend into, checking it against the policy
+	resolveLink := func(file string, osPath string) (isDir bool, err error) {
+		switch policy {
+		case ErrorOnSymlinks:
+			return false, fmt.Errorf("%s is a symlink, which isn't allowed", file)
+		case PreserveSymlinks:
+			target, err := linkTarget(osPath)
+			if err != nil {
+				return false, err
+			}
+			if !isWithin(root, target) {
+				return false, fmt.Errorf("%s links to %s, outside of %s, so it would be broken in the archive", file, target, root)
+			}
+			return false, nil
+		}
+		real, err := filepath.EvalSymlinks(osPath)
+		if err != nil {
+			return false, fmt.Errorf("%s is a broken symlink: %w", file, err)
+		}
+		if !opts.AllowExternalSymlinks && !isWithin(root, real) {
+			return false, fmt.Errorf("%s links to %s, outside of %s", file, real, root)
+		}
+		info, err := os.Stat(real)
+		if err != nil {
+			return false, err
+		}
+		if info.IsDir() && walking[real] {
+			fmt.Fprintf(out, "Skipping symlink cycle: %v\n", file)
+			return false, errSkip
+		}
+		return info.IsDir(), nil
+	}
+
+	var walk func(dir string, realDir string) error
+	walk = func(dir string, realDir string) error {
+		walking[realDir] = true
+		defer delete(walking, realDir)
+		if ignored != nil {
+			ignoreDir := dir
+			if ignoreDir == "" {
+				ignoreDir = "."
+			}
+			if err := ignored.AddDir(fsys, ignoreDir, opts.IgnoreFiles); err != nil {
+				return fmt.Errorf("failed to read ignore files in %s: %w", ignoreDir, err)
+			}
+		}
+		entries, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			file := entry.Name()
+			if dir != "" {
+				file = dir + "/" + file
+			}
+			osPath := filepath.Join(root, filepath.FromSlash(file))
+			isDir := entry.IsDir()
+			realPath := filepath.Join(realDir, entry.Name())
+			if entry.Type()&fs.ModeSymlink != 0 {
+				isDir, err = resolveLink(file, osPath)
+				if err == errSkip {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if isDir {
+					realPath, _ = filepath.EvalSymlinks(osPath)
+				}
+			}
+			if isDir {
+				if ignored != nil && ignorableDir(file, opts.IgnoreExempt) && ignored.Match(file, true) {
+					if couldBeIncluded(rules, file) {
+						fmt.Fprintf(out, "Ignoring: %v/\n", file)
+					}
+					continue
+				}
+				if skipDir(rules, file) {
+					if couldBeIncluded(rules, file) {
+						fmt.Fprintf(out, "Removing: %v/\n", file)
+					}
+					continue
 				}
+				err = walk(file, realPath)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			included, matchedInclude := matchRules(rules, file, out)
+			if !included {
+				if matchedInclude {
+					fmt.Fprintf(out, "Removing: %v\n", file)
+				}
+				continue
+			}
+			if ignored != nil && isIgnoreFile(file, opts.IgnoreFiles) {
+				continue
 			}
+			if ignored != nil && ignorable(file, opts.IgnoreExempt) && ignored.Match(file, false) {
+				fmt.Fprintf(out, "Ignoring: %v\n", file)
+				continue
+			}
+			results = append(results, file)
 		}
+		return nil
 	}
-	return results
+	err = walk("", root)
+	return results, err
 }
 
-func addFilesToZip(path string, files []string, rootDir string, symlinkNodeModules bool, symlinkTarget string) *bytes.Buffer {
-	fsys := getFsys(path)
-	buf := new(bytes.Buffer)
-	w := zip.NewWriter(buf)
-	if symlinkNodeModules {
-		err := addSymlinkToZip(w, "node_modules", fmt.Sprintf("/opt/%s", symlinkTarget))
+var errSkip = errors.New("skip")
+
+// The deflate level archive/zip uses by default
+const defaultLevel = 5
+
+// NoCompression is the CompressionLevel which stores files without compressing them, like the Store globs do
+const NoCompression = -1
+
+// Compressor creates a writer which deflates everything written to it into w at the given level. Writers which
+// have a Reset(io.Writer) method, like flate.Writer, are reused between files.
+type Compressor func(w io.Writer, level int) (io.WriteCloser, error)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{
+		"deflate": func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		// huffman only skips looking for repeated strings, so it's much faster but doesn't shrink files as much
+		"huffman": func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.HuffmanOnly)
+		},
+	}
+)
+
+// RegisterCompressor makes a compressor available by name, eg so a faster deflate implementation can be used.
+// The compressor must produce a raw deflate stream, as the archive records its entries as deflated.
+func RegisterCompressor(name string, compressor Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[name] = compressor
+}
+
+// Compressors returns the names of the registered compressors
+func Compressors() []string {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	names := make([]string, 0, len(compressors))
+	for name := range compressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getCompressor(name string) (Compressor, error) {
+	if name == "" {
+		name = "deflate"
+	}
+	compressorsMu.RLock()
+	compressor, ok := compressors[name]
+	compressorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown compressor '%s', expected one of %s", name, strings.Join(Compressors(), ", "))
+	}
+	return compressor, nil
+}
+
+// Holds on to a worker's compressing writer so it can be reset for the next file rather than rebuilt
+type deflater struct {
+	compressor Compressor
+	level      int
+	writer     io.WriteCloser
+}
+
+func (d *deflater) reset(w io.Writer) (io.WriteCloser, error) {
+	if resetter, ok := d.writer.(interface{ Reset(io.Writer) }); ok {
+		resetter.Reset(w)
+		return d.writer, nil
+	}
+	writer, err := d.compressor(w, d.level)
+	if err != nil {
+		return nil, err
+	}
+	d.writer = writer
+	return writer, nil
+}
+
+// A file to read from disk, compress, and add to the archive under name
+type compressJob struct {
+	name   string
+	source string
+	// fsys holds the source when it's set, otherwise the source is read from disk
+	fsys fs.FS
+	// mode overrides the mode of the source file when set
+	mode fs.FileMode
+	// store leaves the file uncompressed
+	store bool
+	// link is the target of a symlink which is being preserved, in which case source is the link itself
+	link string
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// A compressed file ready to be written to the archive as is
+type compressResult struct {
+	header *zip.FileHeader
+	data   []byte
+	err    error
+}
+
+// Reads and compresses a job's file into memory, filling in everything the zip header needs so the compressed
+// bytes can be copied straight into the archive
+func compress(job compressJob, d *deflater) compressResult {
+	if job.link != "" {
+		return symlinkEntry(job)
+	}
+	var source fs.File
+	var err error
+	if job.fsys != nil {
+		source, err = job.fsys.Open(job.source)
+	} else {
+		source, err = os.Open(job.source)
+	}
+	if err != nil {
+		return compressResult{err: err}
+	}
+	defer source.Close()
+	fileInfo, err := source.Stat()
+	if err != nil {
+		return compressResult{err: err}
+	}
+	mode := job.mode
+	if mode == 0 {
+		mode = fileInfo.Mode()
+	}
+
+	var compressed bytes.Buffer
+	var dst io.WriteCloser = nopCloser{&compressed}
+	method := zip.Store
+	if !job.store {
+		dst, err = d.reset(&compressed)
 		if err != nil {
-			log.Fatal("Failed to create symlink in zip archive", err)
+			return compressResult{err: err}
 		}
+		method = zip.Deflate
 	}
-	for _, file := range files {
-		fileInfo, err := os.Stat(filepath.Join(getFullPath(path), file))
-		zipFileName := file
-		if rootDir != "" {
-			zipFileName = filepath.Join(rootDir, file)
+	crc := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(dst, crc), source)
+	if err != nil {
+		return compressResult{err: err}
+	}
+	err = dst.Close()
+	if err != nil {
+		return compressResult{err: err}
+	}
+
+	header := &zip.FileHeader{
+		Name:               job.name,
+		Method:             method,
+		CRC32:              crc.Sum32(),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: uint64(size),
+	}
+	setModified(header, fileInfo.ModTime())
+	setFlagsAndVersion(header)
+	header.SetMode(mode)
+	return compressResult{header: header, data: compressed.Bytes()}
+}
+
+// Builds the entry for a preserved symlink, which stores the link target as its content
+func symlinkEntry(job compressJob) compressResult {
+	info, err := os.Lstat(job.source)
+	if err != nil {
+		return compressResult{err: err}
+	}
+	data := []byte(job.link)
+	header := &zip.FileHeader{
+		Name:               job.name,
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(len(data)),
+		UncompressedSize64: uint64(len(data)),
+	}
+	setModified(header, info.ModTime())
+	setFlagsAndVersion(header)
+	header.SetMode(fs.ModeSymlink | 0777)
+	return compressResult{header: header, data: data}
+}
+
+// Returns the target to store for a preserved symlink. Absolute targets are made relative to the link, so they
+// still work wherever the archive is extracted.
+func archiveLinkTarget(link string) (string, error) {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		return filepath.ToSlash(target), nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(link))
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(target); err == nil {
+		target = real
+	}
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Sets the flags and versions the same way CreateHeader does, which CreateRaw leaves alone: names which need UTF-8
+// are flagged as such, so unzip tools don't read them as code page 437, and the versions are the ones for deflate, or
+// for zip64 when the file is too big for the plain format
+func setFlagsAndVersion(header *zip.FileHeader) {
+	nameValid, nameRequires := detectUTF8(header.Name)
+	commentValid, commentRequires := detectUTF8(header.Comment)
+	if !header.NonUTF8 && (nameRequires || commentRequires) && nameValid && commentValid {
+		header.Flags |= 0x800
+	}
+	version := uint16(20)
+	if header.CompressedSize64 >= math.MaxUint32 || header.UncompressedSize64 >= math.MaxUint32 {
+		version = 45
+	}
+	header.CreatorVersion = header.CreatorVersion&0xff00 | version
+	header.ReaderVersion = version
+}
+
+// Reports whether a string is valid UTF-8, and whether it needs UTF-8 because it has characters which aren't in the
+// shared subset of ASCII and code page 437
+func detectUTF8(s string) (valid bool, requires bool) {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		if r < 0x20 || r > 0x7d || r == 0x5c {
+			if r == utf8.RuneError && size == 1 {
+				return false, false
+			}
+			requires = true
 		}
-		if err != nil {
-			log.Fatal(err)
+	}
+	return true, requires
+}
+
+// Sets the modified time the same way CreateHeader does from header.Modified, which CreateRaw leaves alone: as an
+// MS-DOS date and time plus an extended timestamp extra field
+func setModified(header *zip.FileHeader, t time.Time) {
+	header.Modified = t
+	dosTime := t
+	if dosTime.Year() < 1980 {
+		dosTime = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	header.ModifiedDate = uint16(dosTime.Day() + int(dosTime.Month())<<5 + (dosTime.Year()-1980)<<9)
+	header.ModifiedTime = uint16(dosTime.Second()/2 + dosTime.Minute()<<5 + dosTime.Hour()<<11)
+
+	extra := make([]byte, 9)
+	binary.LittleEndian.PutUint16(extra[0:], 0x5455) // extended timestamp
+	binary.LittleEndian.PutUint16(extra[2:], 5)      // size of the flags and modified time
+	extra[4] = 1                                     // flags, modified time only
+	binary.LittleEndian.PutUint32(extra[5:], uint32(t.Unix()))
+	header.Extra = append(header.Extra, extra...)
+}
+
+// Compresses the jobs on a pool of workers and writes them to the archive in the order they were given, so the
+// output doesn't depend on which worker finishes first. At most a few jobs per worker are held in memory at once.
+func compressAll(w *zip.Writer, jobs []compressJob, workers int, compressor Compressor, level int) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if level == 0 || level == NoCompression {
+		level = defaultLevel
+	}
+	if level < 1 || level > 9 {
+		return fmt.Errorf("invalid compression level %d, expected 1 to 9 or NoCompression", level)
+	}
+	// check the level up front rather than failing on the first file
+	if _, err := compressor(io.Discard, level); err != nil {
+		return err
+	}
+	queue := make(chan int)
+	results := make([]chan compressResult, len(jobs))
+	for ix := range results {
+		results[ix] = make(chan compressResult, 1)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			d := &deflater{compressor: compressor, level: level}
+			for ix := range queue {
+				results[ix] <- compress(jobs[ix], d)
+			}
+		}()
+	}
+	// pending limits how far the workers can get ahead of the writer
+	pending := make(chan int, workers*4)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(queue)
+		defer close(pending)
+		for ix := range jobs {
+			select {
+			case pending <- ix:
+			case <-done:
+				return
+			}
+			select {
+			case queue <- ix:
+			case <-done:
+				return
+			}
 		}
-		header, err := zip.FileInfoHeader(fileInfo)
-		if err != nil {
-			log.Fatal(err)
+	}()
+
+	for ix := range pending {
+		result := <-results[ix]
+		if result.err != nil {
+			return result.err
 		}
-		header.Name = zipFileName
-		header.Method = zip.Deflate
-		header.SetMode(fileInfo.Mode())
-		f, err := w.CreateHeader(header)
+		f, err := w.CreateRaw(result.header)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		source, err := fsys.Open(file)
+		_, err = f.Write(result.data)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		_, err = io.Copy(f, source)
-		if err != nil {
-			log.Fatal(err)
+	}
+	return nil
+}
+
+// Reports whether a file matches any of the globs
+func matchesAny(patterns []string, file string) bool {
+	for _, pattern := range patterns {
+		if match, _ := doublestar.Match(pattern, file); match {
+			return true
+		}
+	}
+	return false
+}
+
+func addFilesToZip(path string, files []string, opts Options) *bytes.Buffer {
+	compressor, err := getCompressor(opts.Compressor)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fullPath := getFullPath(path)
+	storeAll := opts.CompressionLevel == NoCompression
+	jobs := make([]compressJob, 0, len(files)+len(opts.Entries))
+	for _, file := range files {
+		zipFileName := file
+		if opts.RootDir != "" {
+			zipFileName = filepath.ToSlash(filepath.Join(opts.RootDir, file))
 		}
+		job := compressJob{name: zipFileName, source: filepath.Join(fullPath, file), store: storeAll || matchesAny(opts.Store, file)}
+		if opts.Symlinks == PreserveSymlinks {
+			if info, err := os.Lstat(job.source); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+				job.link, err = archiveLinkTarget(job.source)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	for _, entry := range opts.Entries {
+		jobs = append(jobs, compressJob{name: entry.archiveName(opts.RootDir), source: entry.Source, fsys: entry.FS, mode: entry.Mode, store: storeAll || matchesAny(opts.Store, entry.Name)})
 	}
 
-	err := w.Close()
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	links := opts.Links
+	if opts.SymlinkNodeModules {
+		links = append([]Link{{Name: "node_modules", Target: fmt.Sprintf("/opt/%s", opts.SymlinkTarget)}}, links...)
+	}
+	for _, link := range links {
+		err = addSymlinkToZip(w, link.Name, link.Target)
+		if err != nil {
+			log.Fatal("Failed to create symlink in zip archive", err)
+		}
+	}
+	err = compressAll(w, jobs, opts.Workers, compressor, opts.CompressionLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = w.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -152,7 +953,41 @@ func addFilesToZip(path string, files []string, rootDir string, symlinkNodeModul
 // function's node_modules path. It uses these arguments to create a list of files to be added to the archive,
 // creates the archive, and returns it as a buffer.
 func Create(path string, include []string, exclude []string, rootDir string, symlinkNodeModules bool, symlinkTarget string) *bytes.Buffer {
-	fileList := BuildFileList(path, include, exclude)
-	zip := addFilesToZip(path, fileList, rootDir, symlinkNodeModules, symlinkTarget)
+	return CreateWithOptions(path, Options{
+		Include:            include,
+		Exclude:            exclude,
+		RootDir:            rootDir,
+		SymlinkNodeModules: symlinkNodeModules,
+		SymlinkTarget:      symlinkTarget,
+	})
+}
+
+// CreateWithOptions builds an archive from the files under a base path described by the options, and returns it
+// as a buffer.
+func CreateWithOptions(path string, opts Options) *bytes.Buffer {
+	fileList, err := buildFileList(path, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.Filter != nil {
+		fileList = filterFiles(getFullPath(path), fileList, opts.Filter, opts.LogWriter())
+	}
+	if opts.Cache == nil {
+		return addFilesToZip(path, fileList, opts)
+	}
+
+	key, err := cacheKey(path, fileList, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if data, ok := opts.Cache.Get(key); ok {
+		fmt.Fprintf(opts.LogWriter(), "Reusing cached archive %.12s\n", key)
+		return bytes.NewBuffer(data)
+	}
+	zip := addFilesToZip(path, fileList, opts)
+	err = opts.Cache.Put(key, zip.Bytes())
+	if err != nil {
+		fmt.Fprintf(opts.LogWriter(), "Failed to cache archive: %v\n", err)
+	}
 	return zip
 }
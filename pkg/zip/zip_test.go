@@ -3,9 +3,17 @@ package zip
 import (
 	"archive/zip"
 	"bytes"
+	"compress/flate"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestIncludesStarStar(t *testing.T) {
@@ -102,3 +110,560 @@ func TestCreateZip(t *testing.T) {
 		t.Fatal("length", len(fileNames))
 	}
 }
+
+func TestCreateWithEntries(t *testing.T) {
+	zipData := CreateWithOptions(".", Options{
+		Include: []string{"zip_test.go"},
+		Entries: []Entry{{Source: "zip.go", Name: "bootstrap", Mode: 0755}},
+	})
+	r, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	if len(r.File) != 2 {
+		t.Fatal("length", len(r.File))
+	}
+	bootstrap := r.File[1]
+	if bootstrap.Name != "bootstrap" {
+		t.Fatal("name", bootstrap.Name)
+	}
+	if bootstrap.Mode() != 0755 {
+		t.Fatal("mode", bootstrap.Mode())
+	}
+}
+
+func TestCreateWithRootEntries(t *testing.T) {
+	zipData := CreateWithOptions(".", Options{
+		Include: []string{"zip_test.go"},
+		RootDir: "my-extension",
+		Entries: []Entry{{Source: "zip.go", Name: "extensions/my-extension", Mode: 0755, AtRoot: true}},
+	})
+	r, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	if len(r.File) != 2 || r.File[0].Name != "my-extension/zip_test.go" || r.File[1].Name != "extensions/my-extension" {
+		t.Fatal("Unexpected entries", r.File)
+	}
+}
+
+func TestCreateWithFSEntries(t *testing.T) {
+	fsys := fstest.MapFS{"package/index.js": {Data: []byte("module.exports = 1"), Mode: 0644}}
+	cache := mapCache{}
+	zipData := CreateWithOptions(".", Options{
+		Include: []string{},
+		Entries: []Entry{{FS: fsys, Source: "package/index.js", Name: "node_modules/a/index.js"}},
+		Cache:   cache,
+	})
+	r, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	if len(r.File) != 1 || r.File[0].Name != "node_modules/a/index.js" || r.File[0].Mode() != 0644 {
+		t.Fatal("Unexpected entries", r.File)
+	}
+	rc, _ := r.File[0].Open()
+	content, _ := io.ReadAll(rc)
+	if string(content) != "module.exports = 1" {
+		t.Fatal("content", string(content))
+	}
+
+	fsys["package/index.js"].Data = []byte("module.exports = 2")
+	CreateWithOptions(".", Options{
+		Include: []string{},
+		Entries: []Entry{{FS: fsys, Source: "package/index.js", Name: "node_modules/a/index.js"}},
+		Cache:   cache,
+	})
+	if len(cache) != 2 {
+		t.Fatal("Expected changed contents to build a new archive")
+	}
+}
+
+func TestCreateWithLinks(t *testing.T) {
+	zipData := CreateWithOptions(".", Options{
+		Include:            []string{},
+		SymlinkNodeModules: true,
+		SymlinkTarget:      "nodejs",
+		Links:              []Link{{Name: "lib/node_modules", Target: "/opt/nodejs/node20/node_modules"}},
+	})
+	r, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	expected := map[string]string{"node_modules": "/opt/nodejs", "lib/node_modules": "/opt/nodejs/node20/node_modules"}
+	if len(r.File) != len(expected) {
+		t.Fatal("length", len(r.File))
+	}
+	for _, f := range r.File {
+		if f.Mode()&fs.ModeSymlink == 0 {
+			t.Fatal("Expected a symlink", f.Name)
+		}
+		rc, _ := f.Open()
+		target, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(target) != expected[f.Name] {
+			t.Fatal("target", f.Name, string(target))
+		}
+	}
+}
+
+func TestCreateWithIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".fnpushignore":      "*.log\n!keep.log\n",
+		"index.js":           "",
+		"debug.log":          "",
+		"keep.log":           "",
+		"lib/.gitignore":     "generated/\n",
+		"lib/generated/a.js": "",
+		"lib/b.js":           "",
+		"node_modules/a.log": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal("Error creating directory", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal("Error writing file", err)
+		}
+	}
+	// the nested ignore file is found through the link too
+	if err := os.Symlink("lib", filepath.Join(dir, "linked")); err != nil {
+		t.Fatal("Error creating symlink", err)
+	}
+
+	var log bytes.Buffer
+	zipData := CreateWithOptions(dir, Options{
+		Include:      []string{"**"},
+		IgnoreFiles:  []string{".fnpushignore", ".gitignore"},
+		IgnoreExempt: []string{"node_modules/**"},
+		Log:          &log,
+	})
+	if !strings.Contains(log.String(), "Ignoring: debug.log\n") {
+		t.Fatal("Expected the ignored files to be logged, got", log.String())
+	}
+	r, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	var fileNames []string
+	for _, f := range r.File {
+		fileNames = append(fileNames, f.Name)
+	}
+	sort.Strings(fileNames)
+	expected := []string{"index.js", "keep.log", "lib/b.js", "linked/b.js", "node_modules/a.log"}
+	if strings.Join(fileNames, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v, got %v", expected, fileNames)
+	}
+}
+
+func TestIgnoredDirsArePruned(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte(".git\nbuild/\n"), 0644); err != nil {
+		t.Fatal("Error writing file", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.js"), []byte(""), 0644); err != nil {
+		t.Fatal("Error writing file", err)
+	}
+	// walking into either directory would fail on the broken link
+	for _, ignored := range []string{".git", "build"} {
+		if err := os.Mkdir(filepath.Join(dir, ignored), 0755); err != nil {
+			t.Fatal("Error creating directory", err)
+		}
+		if err := os.Symlink("missing", filepath.Join(dir, ignored, "broken")); err != nil {
+			t.Fatal("Error creating symlink", err)
+		}
+	}
+	files, err := buildFileList(dir, Options{Include: []string{"**"}, IgnoreFiles: []string{".gitignore"}})
+	if err != nil {
+		t.Fatal("Expected ignored directories to be skipped", err)
+	}
+	if len(files) != 1 || files[0] != "index.js" {
+		t.Fatal("files", files)
+	}
+}
+
+func TestNegatedInclude(t *testing.T) {
+	files := BuildFileList(".", []string{"*.go", "!*test.go"}, []string{})
+	if len(files) != 1 || files[0] != "zip.go" {
+		t.Fatal("files", files)
+	}
+}
+
+func TestNegatedExclude(t *testing.T) {
+	files := BuildFileList("../", []string{"**/zip*"}, []string{"zip/**", "!**/zip_test.go"})
+	if len(files) != 1 || files[0] != "zip/zip_test.go" {
+		t.Fatal("files", files)
+	}
+}
+
+func TestLastRuleWins(t *testing.T) {
+	files := BuildFileList("../", []string{"**/zip*"}, []string{"zip/**", "!**/zip_test.go", "**/*test*"})
+	if len(files) != 0 {
+		t.Fatal("files", files)
+	}
+}
+
+func TestOverlappingIncludesAreDeduplicated(t *testing.T) {
+	files := BuildFileList(".", []string{"*.go", "zip.go", "**"}, []string{})
+	if len(files) != 2 {
+		t.Fatal("files", files)
+	}
+}
+
+func TestParallelCompressionKeepsOrder(t *testing.T) {
+	dir := t.TempDir()
+	modified := time.Date(2024, 3, 4, 5, 6, 8, 0, time.UTC)
+	for i := 0; i < 200; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file%03d.txt", i))
+		if err := os.WriteFile(path, bytes.Repeat([]byte(fmt.Sprintf("content %d ", i)), i*10), 0644); err != nil {
+			t.Fatal("Error writing file", err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal("Error setting file times", err)
+		}
+	}
+	serial := CreateWithOptions(dir, Options{Include: []string{"**"}, Workers: 1})
+	parallel := CreateWithOptions(dir, Options{Include: []string{"**"}, Workers: 8})
+	if !bytes.Equal(serial.Bytes(), parallel.Bytes()) {
+		t.Fatal("Expected the archive to be the same however many workers build it")
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(parallel.Bytes()), int64(parallel.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	if len(r.File) != 200 {
+		t.Fatal("length", len(r.File))
+	}
+	for i, f := range r.File {
+		if f.Name != fmt.Sprintf("file%03d.txt", i) {
+			t.Fatal("name", f.Name)
+		}
+		if !f.Modified.Equal(modified) {
+			t.Fatal("modified", f.Modified)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal("Error opening file in zip", err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal("Error reading file in zip", err)
+		}
+		if !bytes.Equal(content, bytes.Repeat([]byte(fmt.Sprintf("content %d ", i)), i*10)) {
+			t.Fatal("content", f.Name)
+		}
+	}
+}
+
+func writeCompressibleFiles(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte("compress me "), 1000), 0644); err != nil {
+			t.Fatal("Error writing file", err)
+		}
+	}
+	return dir
+}
+
+func TestNonASCIINames(t *testing.T) {
+	dir := writeCompressibleFiles(t, "café.js", "index.js")
+	zipData := CreateWithOptions(dir, Options{Include: []string{"**"}})
+	r, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	for _, f := range r.File {
+		if f.ReaderVersion != 20 {
+			t.Fatalf("Expected %s to need version 20, got %d", f.Name, f.ReaderVersion)
+		}
+		if needsUTF8 := f.Name == "café.js"; needsUTF8 != (f.Flags&0x800 != 0) || f.NonUTF8 {
+			t.Fatalf("Unexpected flags %#x for %s", f.Flags, f.Name)
+		}
+	}
+	if r.File[0].Name != "café.js" {
+		t.Fatal("Expected the name to read back the same, got", r.File[0].Name)
+	}
+}
+
+func TestStorePatterns(t *testing.T) {
+	dir := writeCompressibleFiles(t, "index.js", "logo.png")
+	zipData := CreateWithOptions(dir, Options{Include: []string{"**"}, Store: []string{"**/*.png"}})
+	r, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	methods := map[string]uint16{}
+	for _, f := range r.File {
+		methods[f.Name] = f.Method
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal("Error opening file in zip", err)
+		}
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			t.Fatal("Error reading file in zip", f.Name, err)
+		}
+		rc.Close()
+	}
+	if methods["index.js"] != zip.Deflate || methods["logo.png"] != zip.Store {
+		t.Fatal("methods", methods)
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	dir := writeCompressibleFiles(t, "index.js")
+	fastest := CreateWithOptions(dir, Options{Include: []string{"**"}, CompressionLevel: 1, Compressor: "huffman"})
+	smallest := CreateWithOptions(dir, Options{Include: []string{"**"}, CompressionLevel: 9})
+	if smallest.Len() >= fastest.Len() {
+		t.Fatal("Expected level 9 to be smaller than huffman only", smallest.Len(), fastest.Len())
+	}
+	stored := CreateWithOptions(dir, Options{Include: []string{"**"}, CompressionLevel: NoCompression})
+	r, err := zip.NewReader(bytes.NewReader(stored.Bytes()), int64(stored.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	if len(r.File) != 1 || r.File[0].Method != zip.Store {
+		t.Fatal("Expected NoCompression to store the file", r.File)
+	}
+	if err := compressAll(zip.NewWriter(io.Discard), nil, 1, nil, 10); err == nil {
+		t.Fatal("Expected an error for a level above 9")
+	}
+}
+
+// hides flate.Writer's Reset method, so a new writer is needed for each file
+type countingWriter struct {
+	io.WriteCloser
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	calls := 0
+	RegisterCompressor("counting", func(w io.Writer, level int) (io.WriteCloser, error) {
+		calls++
+		fw, err := flate.NewWriter(w, level)
+		return countingWriter{fw}, err
+	})
+	dir := writeCompressibleFiles(t, "a.js", "b.js", "c.js")
+	zipData := CreateWithOptions(dir, Options{Include: []string{"**"}, Compressor: "counting", Workers: 1})
+	if calls != 4 {
+		t.Fatal("Expected a level check and a writer per file for a compressor which can't be reset", calls)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len())); err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	if _, err := getCompressor("missing"); err == nil {
+		t.Fatal("Expected an error for an unknown compressor")
+	}
+}
+
+func TestSkipDir(t *testing.T) {
+	cases := []struct {
+		include []string
+		exclude []string
+		dir     string
+		skip    bool
+	}{
+		{[]string{"**"}, []string{}, "node_modules", false},
+		{[]string{"**"}, []string{"node_modules/**"}, "node_modules", true},
+		{[]string{"**"}, []string{"**/test/**"}, "src/test", true},
+		{[]string{"**"}, []string{"node_modules/**", "!node_modules/a/keep.js"}, "node_modules", false},
+		{[]string{"**"}, []string{"node_modules/**", "!node_modules/a/keep.js"}, "node_modules/b", true},
+		{[]string{"**"}, []string{"node_modules/**", "!**/keep.js"}, "node_modules/b", false},
+		{[]string{"src/**"}, []string{}, "node_modules", true},
+		{[]string{"src/**"}, []string{}, "src", false},
+		{[]string{"src/lib/*.js"}, []string{}, "src", false},
+		{[]string{"*.go"}, []string{}, "pkg", true},
+		{[]string{"{src,lib}/**"}, []string{}, "node_modules", false},
+		{[]string{"node_modules/**", "!node_modules/**"}, []string{}, "node_modules", true},
+	}
+	for _, c := range cases {
+		if actual := skipDir(BuildRules(c.include, c.exclude), c.dir); actual != c.skip {
+			t.Fatalf("Expected skipDir %v for %s with include %v and exclude %v", c.skip, c.dir, c.include, c.exclude)
+		}
+	}
+}
+
+func TestBuildFileListMatchesEveryFileAgainstRules(t *testing.T) {
+	dir := t.TempDir()
+	tree := []string{
+		"index.js",
+		"README.md",
+		"src/app.js",
+		"src/test/app.test.js",
+		"node_modules/a/index.js",
+		"node_modules/a/keep.js",
+		"node_modules/a/test/a.test.js",
+		"node_modules/@s/b/lib/index.js",
+		"node_modules/@s/b/README.md",
+	}
+	for _, name := range tree {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal("Error creating directory", err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal("Error writing file", err)
+		}
+	}
+	sort.Strings(tree)
+	ruleSets := [][2][]string{
+		{{"**"}, {}},
+		{{"**"}, {"node_modules/**"}},
+		{{"**"}, {"node_modules/**", "!node_modules/a/keep.js"}},
+		{{"**", "!**/*.md"}, {"**/test/**"}},
+		{{"src/**", "node_modules/**"}, {"**/test/**", "!node_modules/a/test/**"}},
+		{{"*.js", "src/*.js"}, {}},
+		{{"node_modules/@s/**", "**/index.js"}, {"node_modules/a/**"}},
+	}
+	for _, rs := range ruleSets {
+		rules := BuildRules(rs[0], rs[1])
+		var expected []string
+		for _, file := range tree {
+			if included, _ := matchRules(rules, file, io.Discard); included {
+				expected = append(expected, file)
+			}
+		}
+		actual := BuildFileList(dir, rs[0], rs[1])
+		if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Fatalf("Expected %v for include %v and exclude %v, got %v", expected, rs[0], rs[1], actual)
+		}
+	}
+}
+
+type mapCache map[string][]byte
+
+func (c mapCache) Get(key string) ([]byte, bool) {
+	data, ok := c[key]
+	return data, ok
+}
+
+func (c mapCache) Put(key string, data []byte) error {
+	c[key] = data
+	return nil
+}
+
+func TestCreateWithCache(t *testing.T) {
+	dir := writeCompressibleFiles(t, "index.js", "lib.js")
+	cache := mapCache{}
+	opts := Options{Include: []string{"**"}, Cache: cache}
+	first := CreateWithOptions(dir, opts)
+	if len(cache) != 1 {
+		t.Fatal("Expected the archive to be cached", len(cache))
+	}
+	for key := range cache {
+		cache[key] = []byte("cached")
+	}
+	if second := CreateWithOptions(dir, opts); second.String() != "cached" {
+		t.Fatal("Expected the cached archive to be reused")
+	}
+
+	opts.CompressionLevel = 9
+	if third := CreateWithOptions(dir, opts); third.String() == "cached" || len(cache) != 2 {
+		t.Fatal("Expected different options to build a new archive")
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "lib.js"), later, later); err != nil {
+		t.Fatal("Error setting file times", err)
+	}
+	opts.CompressionLevel = 0
+	if fourth := CreateWithOptions(dir, opts); !bytes.Equal(fourth.Bytes()[:4], first.Bytes()[:4]) || len(cache) != 3 {
+		t.Fatal("Expected a modified file to build a new archive")
+	}
+}
+
+// Builds a pnpm style tree, where node_modules/a links into the .pnpm store and node_modules/loop links back to
+// node_modules
+func writeSymlinkTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	store := filepath.Join(dir, "node_modules", ".pnpm", "a@1.0.0", "node_modules", "a")
+	if err := os.MkdirAll(store, 0755); err != nil {
+		t.Fatal("Error creating directory", err)
+	}
+	if err := os.WriteFile(filepath.Join(store, "index.js"), []byte("module.exports = 1"), 0644); err != nil {
+		t.Fatal("Error writing file", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.js"), []byte("require('a')"), 0644); err != nil {
+		t.Fatal("Error writing file", err)
+	}
+	if err := os.Symlink(filepath.Join(".pnpm", "a@1.0.0", "node_modules", "a"), filepath.Join(dir, "node_modules", "a")); err != nil {
+		t.Fatal("Error creating symlink", err)
+	}
+	if err := os.Symlink(".", filepath.Join(dir, "node_modules", "loop")); err != nil {
+		t.Fatal("Error creating symlink", err)
+	}
+	return dir
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	dir := writeSymlinkTree(t)
+	files, err := buildFileList(dir, Options{Include: []string{"**"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[index.js node_modules/.pnpm/a@1.0.0/node_modules/a/index.js node_modules/a/index.js]"
+	if fmt.Sprint(files) != expected {
+		t.Fatal("files", files)
+	}
+}
+
+func TestPreserveSymlinks(t *testing.T) {
+	dir := writeSymlinkTree(t)
+	if err := os.Remove(filepath.Join(dir, "node_modules", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	zipData := CreateWithOptions(dir, Options{Include: []string{"**"}, Symlinks: PreserveSymlinks})
+	r, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	if err != nil {
+		t.Fatal("Error opening zip archive", err)
+	}
+	var link *zip.File
+	for _, f := range r.File {
+		if f.Name == "node_modules/a" {
+			link = f
+		}
+	}
+	if len(r.File) != 3 || link == nil {
+		t.Fatal("Expected index.js, the store and the link", len(r.File))
+	}
+	if link.Mode()&fs.ModeSymlink == 0 {
+		t.Fatal("mode", link.Mode())
+	}
+	rc, err := link.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(target) != ".pnpm/a@1.0.0/node_modules/a" {
+		t.Fatal("target", string(target))
+	}
+}
+
+func TestSymlinkErrors(t *testing.T) {
+	dir := writeSymlinkTree(t)
+	if _, err := buildFileList(dir, Options{Include: []string{"**"}, Symlinks: ErrorOnSymlinks}); err == nil {
+		t.Fatal("Expected an error for a symlink when they aren't allowed")
+	}
+
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range []SymlinkPolicy{FollowSymlinks, PreserveSymlinks} {
+		if _, err := buildFileList(dir, Options{Include: []string{"**"}, Symlinks: policy}); err == nil {
+			t.Fatal("Expected an error for a symlink escaping the base path", policy)
+		}
+	}
+	files, err := buildFileList(dir, Options{Include: []string{"escape"}, AllowExternalSymlinks: true})
+	if err != nil || len(files) != 1 {
+		t.Fatal("Expected external symlinks to be followed when allowed", files, err)
+	}
+}